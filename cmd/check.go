@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rstms/smtpd-filter-addheader/filter"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"go.yaml.in/yaml/v3"
+	"os"
+	"strings"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check [HEADER...]",
+	Short: "validate configuration",
+	Long: `
+Load the config file and command line options as the filter would,
+report every configuration error, and exit non-zero if any are found
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		f := newFilter()
+		errs := []error{}
+		for _, arg := range args {
+			key, value, err := filter.ParseHeader(arg)
+			if err != nil {
+				errs = append(errs, &filter.ConfigError{Key: "argument", Value: arg, Err: err})
+				continue
+			}
+			f.AddHeader(key, value)
+		}
+		errs = append(errs, f.CheckRules()...)
+		configFile := viper.ConfigFileUsed()
+		for _, err := range errs {
+			fmt.Println(formatCheckError(configFile, err))
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		rules, err := f.LoadRules()
+		cobra.CheckErr(err)
+		if configFile != "" {
+			fmt.Printf("config file: %s\n", configFile)
+		}
+		fmt.Printf("OK: %d headers, %d recipient patterns\n", len(rules.Headers), len(rules.RecipientPatterns))
+	},
+}
+
+func init() {
+	CobraAddCommand(rootCmd, rootCmd, checkCmd)
+}
+
+// prefix the error with the config file line of the offending key and value
+func formatCheckError(configFile string, err error) string {
+	var configErr *filter.ConfigError
+	if configFile != "" && errors.As(err, &configErr) {
+		number, line, found := findConfigLine(configFile, ViperKey(configErr.Key), configErr.Value)
+		if found {
+			return fmt.Sprintf("%s:%d: %v\n    %s", configFile, number, err, strings.TrimSpace(line))
+		}
+	}
+	return fmt.Sprintf("error: %v", err)
+}
+
+// findConfigLine returns the line of the value under the dotted key path,
+// or of the key itself; list items are matched by their name
+func findConfigLine(filename, path, value string) (int, string, bool) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, "", false
+	}
+	var document yaml.Node
+	err = yaml.Unmarshal(data, &document)
+	if err != nil || len(document.Content) == 0 {
+		return 0, "", false
+	}
+	node := findConfigNode(document.Content[0], configKey(path), configKey(value), value)
+	if node == nil {
+		return 0, "", false
+	}
+	lines := strings.Split(string(data), "\n")
+	if node.Line < 1 || node.Line > len(lines) {
+		return 0, "", false
+	}
+	return node.Line, lines[node.Line-1], true
+}
+
+// configKey normalizes a key as viper does
+func configKey(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "-", "_"))
+}
+
+// findConfigNode follows the key path from node, returning the scalar
+// matching value below the end of the path, or the key the path ends at
+func findConfigNode(node *yaml.Node, path, key, value string) *yaml.Node {
+	if path == "" {
+		return findConfigValue(node, key, value)
+	}
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			name := node.Content[i]
+			rest, ok := cutConfigPath(path, configKey(name.Value))
+			if !ok {
+				continue
+			}
+			if found := findConfigNode(node.Content[i+1], rest, key, value); found != nil || rest != "" {
+				return found
+			}
+			return name
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			rest, ok := cutConfigPath(path, configKey(configItemName(item, i)))
+			if !ok {
+				continue
+			}
+			if found := findConfigNode(item, rest, key, value); found != nil || rest != "" {
+				return found
+			}
+			return item
+		}
+	}
+	return nil
+}
+
+// cutConfigPath removes a leading path element, which may contain dots
+func cutConfigPath(path, element string) (string, bool) {
+	if path == element {
+		return "", true
+	}
+	if strings.HasPrefix(path, element+".") {
+		return path[len(element)+1:], true
+	}
+	return "", false
+}
+
+// configItemName returns the name of a list item, defaulting as named rules do
+func configItemName(item *yaml.Node, index int) string {
+	if item.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			if item.Content[i].Value == "name" {
+				return item.Content[i+1].Value
+			}
+		}
+	}
+	return fmt.Sprintf("rule%d", index+1)
+}
+
+// findConfigValue returns the first scalar below node equal to the value,
+// or the name of a list item named by the value
+func findConfigValue(node *yaml.Node, key, value string) *yaml.Node {
+	if node.Kind == yaml.ScalarNode && node.Value == value {
+		return node
+	}
+	for i, child := range node.Content {
+		if node.Kind == yaml.SequenceNode && child.Kind == yaml.MappingNode && configKey(configItemName(child, i)) == key {
+			return child
+		}
+		if found := findConfigValue(child, key, value); found != nil {
+			return found
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"github.com/rstms/smtpd-filter-addheader/filter"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckErrorLine(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := "smtpd_filter_addheader:\n  recipient:\n    - '(unclosed'\n"
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	err := &filter.ConfigError{Key: "recipient", Value: "(unclosed", Err: os.ErrInvalid}
+	message := formatCheckError(configFile, err)
+	require.True(t, strings.HasPrefix(message, configFile+":3: recipient '(unclosed'"))
+	require.True(t, strings.HasPrefix(formatCheckError("", err), "error: "))
+}
+
+func TestFindConfigLine(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := `smtpd_filter_addheader:
+  trace_recipient:
+    - '(unclosed'
+  recipient:
+    - ok
+    - '(unclosed'
+  dkim:
+    example.org:
+      selector: s1
+  rules:
+    - name: first
+      recipient: '(unclosed'
+    - name: second
+      header:
+        - X-Test=(unclosed
+      recipient:
+        - '(unclosed'
+    - header:
+        - X-Unnamed=yes
+`
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	line := func(key, value string) int {
+		number, _, found := findConfigLine(configFile, "smtpd_filter_addheader."+configKey(key), value)
+		if !found {
+			return 0
+		}
+		return number
+	}
+	require.Equal(t, 3, line("trace-recipient", "(unclosed"))
+	require.Equal(t, 6, line("recipient", "(unclosed"))
+	require.Equal(t, 12, line("rules.first.recipient", "(unclosed"))
+	require.Equal(t, 17, line("rules.second.recipient", "(unclosed"))
+	require.Equal(t, 15, line("rules.second.header", "X-Test=(unclosed"))
+	require.Equal(t, 13, line("rules", "second"))
+	require.Equal(t, 19, line("rules.rule3.header", "X-Unnamed=yes"))
+	require.Equal(t, 8, line("dkim.example.org", "/missing/key.pem"))
+	require.Equal(t, 0, line("internal-net", "10.0.0.0/33"))
+}
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/spf13/cobra"
+	"net"
+	"os"
+	"strings"
+)
+
+var controlCmd = &cobra.Command{
+	Use:   "control COMMAND [ARG...]",
+	Short: "send a command to a running filter's control socket",
+	Long: `
+Connect to the control socket of a running filter, send a command and
+print the response.  Commands are:
+  sessions         show the current sessions and their messages
+  rules            show the active rules
+  reload           reload the config file
+  verbose on|off   enable debug logging or restore the configured level
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		socket := ViperGetString("control-socket")
+		if socket == "" {
+			cobra.CheckErr(fmt.Errorf("control-socket is not configured"))
+		}
+		conn, err := net.Dial("unix", socket)
+		cobra.CheckErr(err)
+		defer conn.Close()
+		_, err = fmt.Fprintln(conn, strings.Join(args, " "))
+		cobra.CheckErr(err)
+		scanner := bufio.NewScanner(conn)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "ok" {
+				return
+			}
+			if strings.HasPrefix(line, "error: ") {
+				fmt.Fprintln(os.Stderr, line)
+				os.Exit(1)
+			}
+			fmt.Println(line)
+		}
+		cobra.CheckErr(scanner.Err())
+		cobra.CheckErr(fmt.Errorf("connection closed without response"))
+	},
+}
+
+func init() {
+	CobraAddCommand(rootCmd, rootCmd, controlCmd)
+}
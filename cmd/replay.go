@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/smtpd-filter-addheader/filter"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay TRANSCRIPT [HEADER...]",
+	Short: "replay a captured smtpd protocol transcript",
+	Long: `
+Feed a transcript of the config, report and filter lines received by the
+filter through the filter, and print a diff of the input data-lines
+against the output data-lines for each message.
+With --expect, compare the complete filter output to the expected output
+file and exit non-zero on any difference.  Use --save to write the output
+for use as an expected output file.
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		fp, err := os.Open(args[0])
+		cobra.CheckErr(err)
+		transcript, err := filter.ReadTranscript(fp)
+		fp.Close()
+		cobra.CheckErr(err)
+		f := newFilter()
+		for _, arg := range args[1:] {
+			key, value, err := filter.ParseHeader(arg)
+			cobra.CheckErr(err)
+			f.AddHeader(key, value)
+		}
+		result := filter.Replay(f, transcript)
+		for _, message := range result.Messages {
+			fmt.Printf("### session=%s token=%s\n", message.Session, message.Token)
+			for _, line := range filter.DiffLines(message.Input, message.Output) {
+				fmt.Println(line)
+			}
+		}
+		output := strings.Join(result.Output, "\n") + "\n"
+		saveFile := ViperGetString("replay.save")
+		if saveFile != "" {
+			err := os.WriteFile(saveFile, []byte(output), 0660)
+			cobra.CheckErr(err)
+		}
+		expectFile := ViperGetString("replay.expect")
+		if expectFile != "" {
+			data, err := os.ReadFile(expectFile)
+			cobra.CheckErr(err)
+			if string(data) != output {
+				expected := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+				fmt.Printf("### output differs from %s\n", expectFile)
+				for _, line := range filter.DiffLines(expected, result.Output) {
+					fmt.Println(line)
+				}
+				os.Exit(1)
+			}
+			fmt.Printf("### output matches %s\n", expectFile)
+		}
+	},
+}
+
+func init() {
+	CobraAddCommand(rootCmd, rootCmd, replayCmd)
+	OptionString(replayCmd, "expect", "", "", "expected output file")
+	OptionString(replayCmd, "save", "", "", "write filter output to file")
+}
@@ -33,6 +33,7 @@ package cmd
 import (
 	"github.com/rstms/smtpd-filter-addheader/filter"
 	"github.com/spf13/cobra"
+	"log/slog"
 	"os"
 )
 
@@ -47,19 +48,28 @@ smtpd-filter-addheader modifies all filtered messages by adding the headers
 provided as command line arguments.
 Header arguments are formatted as KEY=VALUE
 At least one header must be provided
+The config file is reloaded on SIGHUP
+A JSON state snapshot is written on SIGUSR1
 `,
 	Args: cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		headers := ViperGetStringSlice("header")
+		f := newFilter()
 		for _, arg := range args {
-			headers = append(headers, arg)
+			key, value, err := filter.ParseHeader(arg)
+			cobra.CheckErr(err)
+			f.AddHeader(key, value)
 		}
-		ViperSet("header", headers)
-		filter := filter.NewFilter(os.Stdin, os.Stdout)
-		filter.Run()
+		f.Run()
 	},
 }
 
+// newFilter returns the command's filter, making its logger the default
+func newFilter() *filter.Filter {
+	f := filter.NewFilter(os.Stdin, os.Stdout)
+	slog.SetDefault(f.Logger())
+	return f
+}
+
 func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
@@ -70,4 +80,51 @@ func init() {
 	CobraInit(rootCmd)
 	OptionStringSlice(rootCmd, "header", "H", []string{}, "header to add (key=value)")
 	OptionStringSlice(rootCmd, "recipient", "R", []string{}, "recipient match regex")
+	OptionStringSlice(rootCmd, "recipient-table", "", []string{}, "recipient match list as an smtpd table (file:PATH or db:PATH)")
+	OptionStringSlice(rootCmd, "header-table", "", []string{}, "header NAME=TABLE with the value of the first recipient found in the smtpd table")
+	OptionString(rootCmd, "footer-text", "", "", "footer appended to text/plain body parts")
+	OptionString(rootCmd, "footer-html", "", "", "footer inserted into text/html body parts")
+	OptionString(rootCmd, "banner-text", "", "", "external sender banner prepended to text/plain body")
+	OptionString(rootCmd, "banner-html", "", "", "external sender banner inserted into text/html body")
+	OptionStringSlice(rootCmd, "internal-net", "", []string{}, "internal network CIDR (no banner)")
+	OptionSwitch(rootCmd, "dry-run", "n", "log modifications without making them")
+	OptionStringSlice(rootCmd, "dry-run-rule", "", []string{}, "rule to evaluate without modifying messages")
+	OptionSwitch(rootCmd, "trace", "", "add a rule decision trace header to each message")
+	OptionStringSlice(rootCmd, "trace-recipient", "", []string{}, "add the trace header only for recipients matching regex")
+	OptionString(rootCmd, "trace-header", "", "X-Addheader-Trace", "trace header name")
+	OptionStringSlice(rootCmd, "sign-header", "", []string{}, "header to cover with an HMAC signature")
+	OptionString(rootCmd, "sign-key-file", "", "", "HMAC signature secret key file")
+	OptionString(rootCmd, "signature-header", "", "X-Addheader-Signature", "HMAC signature header name")
+	OptionSwitch(rootCmd, "verify-signature", "", "verify signed headers instead of signing them")
+	OptionInt(rootCmd, "max-age", "", 7*24*60*60, "reject header signatures older than seconds (0 for no limit)")
+	OptionString(rootCmd, "verify-action", "", "flag", "action for unsigned or invalid signed headers: flag or strip")
+	OptionSwitch(rootCmd, "strip-inbound", "", "remove copies of our own headers from external messages")
+	OptionString(rootCmd, "strip-action", "", "remove", "action for inbound copies of our own headers: remove or rename to X-Original-NAME")
+	OptionStringSlice(rootCmd, "dkim-header", "", []string{}, "header to include in DKIM signatures (default: standard headers)")
+	OptionSwitch(rootCmd, "dkim-verify", "", "verify DKIM signatures of external messages and add an Authentication-Results header")
+	OptionInt(rootCmd, "dns-timeout", "", 5, "DNS lookup timeout seconds (0 for no limit)")
+	OptionInt(rootCmd, "auth-timeout", "", 20, "total seconds of DNS lookups per message (0 for no limit)")
+	OptionString(rootCmd, "authserv-id", "", "", "Authentication-Results authserv-id (default: host FQDN)")
+	OptionSwitch(rootCmd, "spf", "", "evaluate SPF for the envelope sender of external sessions and add a Received-SPF header")
+	OptionSwitch(rootCmd, "dmarc", "", "evaluate DMARC for the From: domain, enabling dkim-verify and spf")
+	OptionString(rootCmd, "arc-key-file", "", "", "ARC sealing private key PEM file")
+	OptionString(rootCmd, "arc-domain", "", "", "ARC sealing domain")
+	OptionString(rootCmd, "arc-selector", "", "", "ARC sealing selector")
+	OptionString(rootCmd, "rules-db", "", "", "load additional named rules from SQLite database file")
+	OptionInt(rootCmd, "rules-db-refresh", "", 60, "rule database refresh interval in seconds (0 disables)")
+	OptionSwitch(rootCmd, "watch-config", "", "reload config when the config file changes")
+	OptionString(rootCmd, "capture", "", "", "write per-session protocol transcripts to directory")
+	OptionSwitch(rootCmd, "capture-redact", "", "omit message body lines from transcripts")
+	OptionInt(rootCmd, "capture-keep", "", 1000, "number of transcript files to keep")
+	OptionString(rootCmd, "log-level", "", "", "log level: debug, info, warn or error (default info, debug if verbose)")
+	OptionString(rootCmd, "log-format", "", "text", "log format: text, logfmt or json")
+	OptionString(rootCmd, "log-output", "", "stderr", "log output: stderr or syslog")
+	OptionString(rootCmd, "syslog-facility", "", "mail", "syslog facility")
+	OptionString(rootCmd, "metrics-listen", "", "", "serve Prometheus metrics on TCP address or unix socket path")
+	OptionString(rootCmd, "audit-log", "", "", "write NDJSON audit records of message modifications to file")
+	OptionInt(rootCmd, "audit-max-size", "", 10*1024*1024, "rotate audit log at size in bytes")
+	OptionInt(rootCmd, "audit-keep", "", 5, "number of rotated audit logs to keep")
+	OptionString(rootCmd, "state-file", "", "", "write SIGUSR1 state dumps to file instead of the log")
+	OptionString(rootCmd, "control-socket", "", "", "admin control unix socket path")
+	OptionString(rootCmd, "syslog-socket", "", "/dev/log", "syslog unix datagram socket")
 }
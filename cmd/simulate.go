@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/rstms/smtpd-filter-addheader/filter"
+	"github.com/spf13/cobra"
+	"net/mail"
+	"os"
+)
+
+var simulateCmd = &cobra.Command{
+	Use:   "simulate EML_FILE [HEADER...]",
+	Short: "run a message file through the filter",
+	Long: `
+Generate the smtpd protocol events for delivery of an RFC 5322 message
+file, run them through the filter, and print the filtered message with a
+summary of the actions taken.  Recipients default to the To and Cc header
+addresses.
+`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		fp, err := os.Open(args[0])
+		cobra.CheckErr(err)
+		message, err := filter.ReadMessage(fp)
+		fp.Close()
+		cobra.CheckErr(err)
+		env := filter.Envelope{
+			From:     ViperGetString("simulate.from"),
+			To:       ViperGetStringSlice("simulate.rcpt"),
+			Remote:   ViperGetString("simulate.remote"),
+			Local:    ViperGetString("simulate.local"),
+			RDNS:     ViperGetString("simulate.rdns"),
+			Helo:     ViperGetString("simulate.helo"),
+			AuthUser: ViperGetString("simulate.auth_user"),
+		}
+		if len(env.To) == 0 {
+			env.To = headerAddresses(args[0], "To", "Cc")
+		}
+		f := newFilter()
+		for _, arg := range args[1:] {
+			key, value, err := filter.ParseHeader(arg)
+			cobra.CheckErr(err)
+			f.AddHeader(key, value)
+		}
+		result, err := filter.Simulate(f, &env, message)
+		cobra.CheckErr(err)
+		for _, line := range result.Lines {
+			fmt.Println(line)
+		}
+		fmt.Println()
+		fmt.Printf("# from=%s rcpt=%v remote=%s helo=%s auth=%s\n", env.From, env.To, env.Remote, env.Helo, env.AuthUser)
+		if len(result.Actions) == 0 {
+			fmt.Println("# no rules fired")
+		}
+		for _, action := range result.Actions {
+			fmt.Printf("# %s: %s %s\n", action.Rule, action.Action, action.Detail)
+		}
+	},
+}
+
+func init() {
+	CobraAddCommand(rootCmd, rootCmd, simulateCmd)
+	OptionString(simulateCmd, "from", "", "", "envelope sender")
+	OptionStringSlice(simulateCmd, "rcpt", "", []string{}, "envelope recipient")
+	OptionString(simulateCmd, "remote", "", "192.0.2.1:11223", "client address")
+	OptionString(simulateCmd, "local", "", "192.0.2.2:25", "server address")
+	OptionString(simulateCmd, "rdns", "", "client.example.org", "client reverse DNS name")
+	OptionString(simulateCmd, "helo", "", "client.example.org", "client HELO name")
+	OptionString(simulateCmd, "auth-user", "", "", "authenticated username")
+}
+
+// return the addresses from the named header fields of a message file
+func headerAddresses(filename string, fields ...string) []string {
+	addresses := []string{}
+	fp, err := os.Open(filename)
+	cobra.CheckErr(err)
+	defer fp.Close()
+	message, err := mail.ReadMessage(fp)
+	cobra.CheckErr(err)
+	for _, field := range fields {
+		list, err := message.Header.AddressList(field)
+		if err != nil {
+			continue
+		}
+		for _, address := range list {
+			addresses = append(addresses, address.Address)
+		}
+	}
+	return addresses
+}
@@ -0,0 +1,301 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RFC 8617 limits the chain to this many ARC sets
+const ARC_MAX_INSTANCES = 50
+
+// ARCResult is the outcome of validating the ARC chain of a message
+type ARCResult struct {
+	Result   string
+	Reason   string
+	Instance int
+}
+
+// String formats the result as an Authentication-Results resinfo
+func (r *ARCResult) String() string {
+	s := "arc=" + r.Result
+	if r.Reason != "" {
+		s += " (" + r.Reason + ")"
+	}
+	return s
+}
+
+// arcSet holds the header fields of one ARC instance
+type arcSet struct {
+	results   []string
+	signature []string
+	seal      []string
+}
+
+// arcInstance returns the i= tag value of an ARC header field
+func arcInstance(field []string) (int, error) {
+	tag, _, _ := strings.Cut(fieldValue(field), ";")
+	key, value, ok := strings.Cut(tag, "=")
+	if !ok || strings.TrimSpace(key) != "i" {
+		return 0, fmt.Errorf("missing i= tag")
+	}
+	i, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || i < 1 || i > ARC_MAX_INSTANCES {
+		return 0, fmt.Errorf("invalid i= tag")
+	}
+	return i, nil
+}
+
+// arcSets returns the ARC sets of the header by instance and the highest instance
+func arcSets(fields [][]string) (map[int]*arcSet, int, error) {
+	sets := make(map[int]*arcSet)
+	count := 0
+	for _, field := range fields {
+		name := strings.ToLower(fieldName(field))
+		if name != "arc-seal" && name != "arc-message-signature" && name != "arc-authentication-results" {
+			continue
+		}
+		i, err := arcInstance(field)
+		if err != nil {
+			return nil, 0, err
+		}
+		set, ok := sets[i]
+		if !ok {
+			set = &arcSet{}
+			sets[i] = set
+		}
+		var slot *[]string
+		switch name {
+		case "arc-seal":
+			slot = &set.seal
+		case "arc-message-signature":
+			slot = &set.signature
+		default:
+			slot = &set.results
+		}
+		if *slot != nil {
+			return nil, 0, fmt.Errorf("duplicate %s i=%d", fieldName(field), i)
+		}
+		*slot = field
+		count = max(count, i)
+	}
+	for i := 1; i <= count; i++ {
+		set, ok := sets[i]
+		if !ok || set.seal == nil || set.signature == nil || set.results == nil {
+			return nil, 0, fmt.Errorf("incomplete ARC set i=%d", i)
+		}
+	}
+	return sets, count, nil
+}
+
+// chainFailed returns true if the last seal of the chain records a failed chain
+func chainFailed(fields [][]string) bool {
+	sets, count, err := arcSets(fields)
+	if err != nil || count == 0 {
+		return false
+	}
+	tags, err := parseTags(fieldValue(sets[count].seal))
+	return err == nil && tags["cv"] == "fail"
+}
+
+// sealData returns the relaxed canonical ARC sets signed by the seal of
+// the last instance, without its b= value
+func sealData(sets map[int]*arcSet, last int) string {
+	var data strings.Builder
+	for i := 1; i <= last; i++ {
+		data.WriteString(relaxedHeader(sets[i].results))
+		data.WriteString(relaxedHeader(sets[i].signature))
+		if i < last {
+			data.WriteString(relaxedHeader(sets[i].seal))
+		}
+	}
+	data.WriteString(strings.TrimSuffix(relaxedHeader(removeSignatureValue(sets[last].seal)), "\r\n"))
+	return data.String()
+}
+
+// VerifyARC validates the ARC chain of an unstuffed message
+func VerifyARC(ctx context.Context, resolver Resolver, lines []string) *ARCResult {
+	header, body := splitMessage(lines)
+	fields := headerFields(header)
+	sets, count, err := arcSets(fields)
+	if err != nil {
+		return &ARCResult{Result: "fail", Reason: err.Error()}
+	}
+	result := &ARCResult{Result: "none", Instance: count}
+	fail := func(format string, args ...any) *ARCResult {
+		result.Result = "fail"
+		result.Reason = fmt.Sprintf(format, args...)
+		return result
+	}
+	if count == 0 {
+		return result
+	}
+	for i := 1; i <= count; i++ {
+		tags, err := parseTags(fieldValue(sets[i].seal))
+		if err != nil {
+			return fail("seal i=%d: %v", i, err)
+		}
+		expected := "pass"
+		if i == 1 {
+			expected = "none"
+		}
+		if tags["cv"] != expected {
+			return fail("seal i=%d has cv=%s", i, tags["cv"])
+		}
+	}
+	tags, err := parseTags(fieldValue(sets[count].signature))
+	if err != nil {
+		return fail("message signature i=%d: %v", count, err)
+	}
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return fail("message signature i=%d missing %s= tag", count, tag)
+		}
+	}
+	for _, name := range strings.Split(removeWhitespace(tags["h"]), ":") {
+		if strings.EqualFold(name, "ARC-Seal") {
+			return fail("message signature i=%d signs ARC-Seal", count)
+		}
+	}
+	status, reason := verifyMessageSignature(ctx, resolver, tags, fields, body, sets[count].signature)
+	if status != "pass" {
+		return fail("message signature i=%d: %s", count, reason)
+	}
+	for i := count; i >= 1; i-- {
+		tags, _ := parseTags(fieldValue(sets[i].seal))
+		for _, tag := range []string{"a", "b", "d", "s"} {
+			if tags[tag] == "" {
+				return fail("seal i=%d missing %s= tag", i, tag)
+			}
+		}
+		status, reason := verifyHash(ctx, resolver, tags, sealData(sets, i))
+		if status != "pass" {
+			return fail("seal i=%d: %s", i, reason)
+		}
+	}
+	result.Result = "pass"
+	return result
+}
+
+// ARCSeal returns the ARC-Seal, ARC-Message-Signature and
+// ARC-Authentication-Results fields of a new ARC set for an unstuffed
+// message; chain is the validation result of the existing chain
+func ARCSeal(key *DKIMKey, lines []string, authServId string, results []string, chain string, candidates []string, timestamp time.Time) ([]string, error) {
+	header, body := splitMessage(lines)
+	fields := headerFields(header)
+	sets, count, err := arcSets(fields)
+	if err != nil {
+		// a broken chain is sealed as failed
+		sets, count, chain = make(map[int]*arcSet), 0, "fail"
+		for _, field := range fields {
+			if i, err := arcInstance(field); err == nil && strings.HasPrefix(strings.ToLower(fieldName(field)), "arc-") {
+				count = max(count, i)
+			}
+		}
+	}
+	instance := count + 1
+	if instance > ARC_MAX_INSTANCES {
+		return nil, fmt.Errorf("ARC chain has %d instances", count)
+	}
+	if instance == 1 {
+		chain = "none"
+	}
+	set := &arcSet{}
+	set.results = foldHeader(fmt.Sprintf("ARC-Authentication-Results: i=%d; %s; %s", instance, authServId, strings.Join(results, "; ")))
+	names := signedNames(fields, candidates)
+	set.signature, err = signHeaderField(key, "ARC-Message-Signature", []string{
+		fmt.Sprintf("i=%d;", instance),
+		"a=" + key.Algorithm + ";",
+		"c=relaxed/relaxed;",
+		"d=" + key.Domain + ";",
+		"s=" + key.Selector + ";",
+		fmt.Sprintf("t=%d;", timestamp.Unix()),
+		"h=" + strings.Join(names, ":") + ";",
+		"bh=" + bodyHash(body) + ";",
+	}, selectHeaders(fields, names))
+	if err != nil {
+		return nil, err
+	}
+	var data strings.Builder
+	if chain != "fail" {
+		for i := 1; i <= count; i++ {
+			data.WriteString(relaxedHeader(sets[i].results))
+			data.WriteString(relaxedHeader(sets[i].signature))
+			data.WriteString(relaxedHeader(sets[i].seal))
+		}
+	}
+	data.WriteString(relaxedHeader(set.results))
+	data.WriteString(relaxedHeader(set.signature))
+	set.seal, err = signHeaderField(key, "ARC-Seal", []string{
+		fmt.Sprintf("i=%d;", instance),
+		"a=" + key.Algorithm + ";",
+		"cv=" + chain + ";",
+		"d=" + key.Domain + ";",
+		"s=" + key.Selector + ";",
+		fmt.Sprintf("t=%d;", timestamp.Unix()),
+	}, data.String())
+	if err != nil {
+		return nil, err
+	}
+	return append(append(set.seal, set.signature...), set.results...), nil
+}
+
+// buildARC reads the ARC sealing options
+func (r *RuleSet) buildARC() []error {
+	keyFile := ViperGetString("arc-key-file")
+	if keyFile == "" {
+		return []error{}
+	}
+	domain := ViperGetString("arc-domain")
+	selector := ViperGetString("arc-selector")
+	if domain == "" || selector == "" {
+		return []error{&ConfigError{"arc-key-file", keyFile, fmt.Errorf("arc-domain and arc-selector are required")}}
+	}
+	key, err := LoadDKIMKey(domain, selector, keyFile)
+	if err != nil {
+		return []error{&ConfigError{"arc-key-file", keyFile, err}}
+	}
+	r.ARCKey = key
+	return []error{}
+}
+
+// arcSeal validates the ARC chain of the message as received and prepends
+// a new ARC set to the buffered message lines
+func (f *Filter) arcSeal(log *slog.Logger, message *Message, lines []string) []string {
+	rules := message.Rules
+	key := rules.ARCKey
+	resolver, ctx, cancel := f.lookupContext(message)
+	defer cancel()
+	message.ARC = VerifyARC(ctx, resolver, unstuffLines(message.Input))
+	log.Info("ARC chain verified", "rule", "arc", "result", message.ARC.Result, "reason", message.ARC.Reason, "instance", message.ARC.Instance)
+	header, _ := splitMessage(unstuffLines(message.Input))
+	if chainFailed(headerFields(header)) {
+		log.Info("ARC chain already failed, not sealed", "rule", "arc")
+		return lines
+	}
+	candidates := append(append([]string{}, rules.DKIMHeaders...), rules.OwnHeaders()...)
+	candidates = append(candidates, "DKIM-Signature", "Authentication-Results")
+	results := append(authResults(message), message.ARC.String())
+	seal, err := ARCSeal(key, unstuffLines(lines), rules.AuthServId, results, message.ARC.Result, candidates, time.Now())
+	if err != nil {
+		log.Error("ARC sealing failed", "rule", "arc", "domain", key.Domain, "error", err)
+		return lines
+	}
+	detail := fmt.Sprintf("ARC-Seal i=%d d=%s s=%s", message.ARC.Instance+1, key.Domain, key.Selector)
+	if rules.IsDryRun("arc") {
+		log.Info("dry-run: header not added", "rule", "arc", "action", "add-header", "header", "ARC-Seal", "domain", key.Domain, "selector", key.Selector, "dry_run", true)
+		message.Actions = append(message.Actions, Action{"arc", "dry-run add-header", detail})
+		f.Metrics.dryRun("arc", "add-header")
+		return lines
+	}
+	log.Info("header added", "rule", "arc", "action", "add-header", "header", "ARC-Seal", "domain", key.Domain, "selector", key.Selector)
+	message.Actions = append(message.Actions, Action{"arc", "add-header", detail})
+	f.Metrics.headerAdded("arc", "ARC-Seal")
+	for _, field := range headerFields(seal) {
+		message.audit.addHeader("arc", field)
+	}
+	return append(stuffLines(seal), lines...)
+}
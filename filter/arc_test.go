@@ -0,0 +1,183 @@
+package filter
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestARCSeal(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.Nil(t, err)
+	resolver := NewMemoryResolver()
+	resolver.TXT["arc._domainkey.lists.example.org"] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPublic)}
+	resolver.TXT["ed._domainkey.forward.example.net"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPublic)}
+	listKey, err := NewDKIMKey("lists.example.org", "arc", rsaKey)
+	require.Nil(t, err)
+	forwardKey, err := NewDKIMKey("forward.example.net", "ed", edKey)
+	require.Nil(t, err)
+
+	message := []string{"From: fromuser@example.com", "To: list@lists.example.org", "Subject: arc", "", "body"}
+	require.Equal(t, "none", VerifyARC(context.Background(), resolver, message).Result)
+
+	seal, err := ARCSeal(listKey, message, "lists.example.org", []string{"dkim=pass header.d=example.com"}, "none", dkimDefaultHeaders, time.Now())
+	require.Nil(t, err)
+	first := append(seal, message...)
+	fields := headerFields(seal)
+	require.Equal(t, []string{"ARC-Seal", "ARC-Message-Signature", "ARC-Authentication-Results"}, []string{fieldName(fields[0]), fieldName(fields[1]), fieldName(fields[2])})
+	require.Contains(t, fieldValue(fields[0]), "i=1; a=rsa-sha256; cv=none; d=lists.example.org; s=arc;")
+	require.Contains(t, fieldValue(fields[1]), "h=From:Subject:To;")
+	require.Equal(t, "i=1; lists.example.org; dkim=pass header.d=example.com", fieldValue(fields[2]))
+	result := VerifyARC(context.Background(), resolver, first)
+	require.Equal(t, "pass", result.Result, result.Reason)
+	require.Equal(t, 1, result.Instance)
+
+	// the list adds a footer, the forwarder seals the modified message
+	modified := append(append([]string{}, first...), "-- list footer")
+	require.Equal(t, "fail", VerifyARC(context.Background(), resolver, modified).Result)
+	seal, err = ARCSeal(forwardKey, modified, "forward.example.net", []string{"arc=pass"}, "pass", dkimDefaultHeaders, time.Now())
+	require.Nil(t, err)
+	require.Contains(t, fieldValue(headerFields(seal)[0]), "i=2; a=ed25519-sha256; cv=pass;")
+	second := append(seal, modified...)
+	result = VerifyARC(context.Background(), resolver, second)
+	require.Equal(t, "pass", result.Result, result.Reason)
+	require.Equal(t, 2, result.Instance)
+
+	// tampering with an earlier ARC set breaks the seals covering it
+	tampered := slices.Clone(second)
+	for i, line := range tampered {
+		tampered[i] = strings.Replace(line, "dkim=pass header.d=example.com", "dkim=fail header.d=example.com", 1)
+	}
+	require.NotEqual(t, second, tampered)
+	result = VerifyARC(context.Background(), resolver, tampered)
+	require.Equal(t, "fail", result.Result)
+	require.Equal(t, "seal i=2: signature did not verify", result.Reason)
+
+	// a missing ARC set member breaks the chain structure
+	result = VerifyARC(context.Background(), resolver, second[len(headerFields(seal)[0]):])
+	require.Equal(t, "fail", result.Result)
+	require.Equal(t, "incomplete ARC set i=2", result.Reason)
+
+	// a failed chain is sealed with cv=fail and is not sealed again
+	seal, err = ARCSeal(forwardKey, tampered, "forward.example.net", []string{"arc=fail"}, "fail", dkimDefaultHeaders, time.Now())
+	require.Nil(t, err)
+	require.Contains(t, fieldValue(headerFields(seal)[0]), "i=3; a=ed25519-sha256; cv=fail;")
+	require.True(t, chainFailed(headerFields(append(seal, tampered...))))
+	require.Equal(t, "fail", VerifyARC(context.Background(), resolver, append(seal, tampered...)).Result)
+}
+
+// TestARCVector checks an ARC set made with the RFC 8463 appendix A key
+// and message, whose published DKIM signature must verify first; the ARC
+// set is signed over the canonical forms of RFC 8617 section 5.1 below
+func TestARCVector(t *testing.T) {
+	resolver := NewMemoryResolver()
+	resolver.TXT["brisbane._domainkey.football.example.com"] = []string{"v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="}
+	message := []string{
+		"From: Joe SixPack <joe@football.example.com>",
+		"To: Suzie Q <suzie@shopping.example.net>",
+		"Subject: Is dinner ready?",
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)",
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>",
+		"",
+		"Hi.",
+		"",
+		"We lost the game.  Are you hungry yet?",
+		"",
+		"Joe.",
+	}
+	signature := []string{
+		"DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;",
+		" d=football.example.com; i=@football.example.com;",
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :",
+		" subject : date : message-id : from : subject : date;",
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;",
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11BusFa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==",
+	}
+	results := VerifyDKIM(context.Background(), resolver, append(signature, message...), time.Unix(1528637909, 0))
+	require.Len(t, results, 1)
+	require.Equal(t, "pass", results[0].Result, results[0].Reason)
+
+	set := []string{
+		"ARC-Seal: i=1; a=ed25519-sha256; cv=none; d=football.example.com;",
+		" s=brisbane; t=1528637909;",
+		" b=ReQ4Dwt1nTzXX1d/FJYMA6BERhYPHb/D//RZumvcQjJAOzfvpKRsJX7EQbas0uDEJna+p/5DUFpbzYppadVcDw==",
+		"ARC-Message-Signature: i=1; a=ed25519-sha256; c=relaxed/relaxed;",
+		" d=football.example.com; s=brisbane; t=1528637909;",
+		" h=from:to:subject:date:message-id;",
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;",
+		" b=+WODgkiLPGkPXM6mJuzKMCTst7qHetyQl8wTaDl1V1txO5PP3L0UepHp9Yr+qwWppWwc0h5XYLR2ztu73qPICw==",
+		"ARC-Authentication-Results: i=1; mx.football.example.com;",
+		"  dkim=pass header.d=football.example.com",
+	}
+	sets, count, err := arcSets(headerFields(set))
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+	require.Equal(t, "arc-authentication-results:i=1; mx.football.example.com; dkim=pass header.d=football.example.com\r\n"+
+		"arc-message-signature:i=1; a=ed25519-sha256; c=relaxed/relaxed; d=football.example.com; s=brisbane; t=1528637909; h=from:to:subject:date:message-id; bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=; b=+WODgkiLPGkPXM6mJuzKMCTst7qHetyQl8wTaDl1V1txO5PP3L0UepHp9Yr+qwWppWwc0h5XYLR2ztu73qPICw==\r\n"+
+		"arc-seal:i=1; a=ed25519-sha256; cv=none; d=football.example.com; s=brisbane; t=1528637909; b=", sealData(sets, 1))
+	result := VerifyARC(context.Background(), resolver, append(set, message...))
+	require.Equal(t, "pass", result.Result, result.Reason)
+	require.Equal(t, 1, result.Instance)
+
+	modified := slices.Clone(append(set, message...))
+	modified[len(modified)-1] = "Jim."
+	result = VerifyARC(context.Background(), resolver, modified)
+	require.Equal(t, "fail", result.Result)
+	require.Equal(t, "message signature i=1: body hash did not verify", result.Reason)
+}
+
+func TestARCFilter(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	ViperSet("arc-key-file", writeKey(t, edKey))
+	ViperSet("arc-domain", "localdomain.ext")
+	ViperSet("arc-selector", "arc")
+	ViperSet("authserv-id", "mx.localdomain.ext")
+	defer func() {
+		ViperSet("arc-key-file", "")
+		ViperSet("arc-domain", "")
+		ViperSet("arc-selector", "")
+		ViperSet("authserv-id", "")
+	}()
+	resolver := NewMemoryResolver()
+	resolver.TXT["arc._domainkey.localdomain.ext"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))}
+
+	message := []string{"From: fromuser@example.org", "To: touser@localdomain.ext", "Subject: arc", "", "body"}
+	env := Envelope{From: "fromuser@example.org", To: []string{"touser@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+	f := NewFilter(nil, nil)
+	f.Resolver = resolver
+	f.FooterText = "-- footer"
+	result, err := Simulate(f, &env, message)
+	require.Nil(t, err)
+	fields := headerFields(result.Lines[:slices.Index(result.Lines, "")])
+	require.Equal(t, "ARC-Seal", fieldName(fields[0]))
+	require.Equal(t, "i=1; mx.localdomain.ext; arc=none", fieldValue(fields[2]))
+	require.Contains(t, fieldValue(fields[1]), "h=From:Subject:To;")
+	require.Contains(t, result.Lines, "-- footer")
+	arc := VerifyARC(context.Background(), resolver, result.Lines)
+	require.Equal(t, "pass", arc.Result, arc.Reason)
+
+	// the sealed message is sealed again by the next hop
+	result, err = Simulate(f, &env, result.Lines)
+	require.Nil(t, err)
+	fields = headerFields(result.Lines[:slices.Index(result.Lines, "")])
+	require.Contains(t, fieldValue(fields[0]), "i=2; a=ed25519-sha256; cv=pass;")
+	require.Equal(t, "i=2; mx.localdomain.ext; arc=pass", fieldValue(fields[2]))
+	arc = VerifyARC(context.Background(), resolver, result.Lines)
+	require.Equal(t, "pass", arc.Result, arc.Reason)
+	require.Equal(t, 2, arc.Instance)
+}
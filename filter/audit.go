@@ -0,0 +1,167 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// AuditRecord describes the header modifications made to one message
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Session  string    `json:"session"`
+	Message  string    `json:"message"`
+	From     string    `json:"from"`
+	To       []string  `json:"to"`
+	Remote   string    `json:"remote"`
+	AuthUser string    `json:"auth_user,omitempty"`
+	Rules    []string  `json:"rules"`
+	Added    []string  `json:"added,omitempty"`
+	Removed  []string  `json:"removed,omitempty"`
+	Changed  []string  `json:"changed,omitempty"`
+}
+
+// AuditLog appends newline-delimited JSON records to a file, rotating it
+// to Path.1 ... Path.Keep when it would exceed MaxSize bytes
+type AuditLog struct {
+	Path    string
+	MaxSize int64
+	Keep    int
+	file    *os.File
+	size    int64
+	mutex   sync.Mutex
+}
+
+func NewAuditLog(path string, maxSize int64, keep int) (*AuditLog, error) {
+	a := AuditLog{Path: path, MaxSize: maxSize, Keep: keep}
+	err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// EnableAudit writes an audit record for each modified message to path
+func (f *Filter) EnableAudit(path string, maxSize int64, keep int) error {
+	audit, err := NewAuditLog(path, maxSize, keep)
+	if err != nil {
+		return err
+	}
+	f.audit = audit
+	return nil
+}
+
+func (a *AuditLog) open() error {
+	file, err := os.OpenFile(a.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+func (a *AuditLog) rotate() error {
+	err := a.file.Close()
+	a.file = nil
+	if err != nil {
+		return err
+	}
+	if a.Keep > 0 {
+		for i := a.Keep - 1; i > 0; i-- {
+			err := os.Rename(fmt.Sprintf("%s.%d", a.Path, i), fmt.Sprintf("%s.%d", a.Path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		err = os.Rename(a.Path, a.Path+".1")
+	} else {
+		err = os.Remove(a.Path)
+	}
+	if err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Write appends record to the log
+func (a *AuditLog) Write(record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		err := a.open()
+		if err != nil {
+			return err
+		}
+	}
+	if a.MaxSize > 0 && a.size > 0 && a.size+int64(len(data)) > a.MaxSize {
+		err := a.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(data)
+	a.size += int64(n)
+	return err
+}
+
+func (a *AuditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// NewAuditRecord returns a record of the session and message envelope
+func NewAuditRecord(session *Session, message *Message) *AuditRecord {
+	return &AuditRecord{
+		Time:     time.Now().UTC(),
+		Session:  session.Id,
+		Message:  message.Id,
+		From:     message.From,
+		To:       message.To,
+		Remote:   session.Remote,
+		AuthUser: session.AuthorizedUser,
+		Rules:    []string{},
+	}
+}
+
+// addHeader records a header field added by a rule
+func (r *AuditRecord) addHeader(rule string, field []string) {
+	if r == nil {
+		return
+	}
+	r.Added = append(r.Added, fieldName(field)+": "+fieldValue(field))
+	if !slices.Contains(r.Rules, rule) {
+		r.Rules = append(r.Rules, rule)
+	}
+}
+
+// writeAudit writes the audit record of a modified message
+func (f *Filter) writeAudit(log *slog.Logger, record *AuditRecord) {
+	if f.audit == nil || (len(record.Added) == 0 && len(record.Removed) == 0 && len(record.Changed) == 0) {
+		return
+	}
+	err := f.audit.Write(record)
+	if err != nil {
+		log.Error("audit log write failed", "error", err)
+	}
+}
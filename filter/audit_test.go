@@ -0,0 +1,82 @@
+package filter
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAudit(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Audit", "audited")
+	require.Nil(t, f.EnableAudit(filename, 0, 0))
+	replayTranscript(t, f)
+
+	data, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	var record AuditRecord
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, "deadbeef", record.Session)
+	require.Equal(t, "cafebabe", record.Message)
+	require.Equal(t, "fromuser@example.org", record.From)
+	require.Equal(t, []string{"touser@localdomain.ext"}, record.To)
+	require.Equal(t, "1.2.3.4:11223", record.Remote)
+	require.Equal(t, "authuser", record.AuthUser)
+	require.Equal(t, []string{"headers"}, record.Rules)
+	require.Equal(t, []string{"X-Audit: audited"}, record.Added)
+}
+
+func TestAuditRotate(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := NewAuditLog(filename, 300, 2)
+	require.Nil(t, err)
+	defer audit.Close()
+	record := AuditRecord{Session: "deadbeef", Message: "cafebabe", To: []string{}, Rules: []string{"headers"}}
+	for i := 0; i < 10; i++ {
+		require.Nil(t, audit.Write(&record))
+	}
+	for _, name := range []string{filename, filename + ".1", filename + ".2"} {
+		info, err := os.Stat(name)
+		require.Nil(t, err)
+		require.LessOrEqual(t, info.Size(), int64(300))
+	}
+	_, err = os.Stat(filename + ".3")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestAuditSigned(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	ViperSet("dkim", []any{map[string]any{"domain": "example.org", "selector": "ed", "key_file": writeKey(t, edKey)}})
+	defer ViperSet("dkim", nil)
+
+	// headers added to the complete message are audited
+	filename := filepath.Join(t.TempDir(), "audit.log")
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Audit", "audited")
+	require.Nil(t, f.EnableAudit(filename, 0, 0))
+	env := Envelope{From: "fromuser@example.org", To: []string{"touser@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+	_, err = Simulate(f, &env, []string{"From: fromuser@example.org", "Subject: signed", "", "body"})
+	require.Nil(t, err)
+
+	data, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	var record AuditRecord
+	require.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+	require.Equal(t, []string{"headers", "dkim"}, record.Rules)
+	require.Len(t, record.Added, 2)
+	require.Equal(t, "X-Audit: audited", record.Added[0])
+	require.True(t, strings.HasPrefix(record.Added[1], "DKIM-Signature: v=1; a=ed25519-sha256;"), record.Added[1])
+}
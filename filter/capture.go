@@ -0,0 +1,203 @@
+package filter
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Capture writes the protocol lines received and sent by the filter to a
+// file per session.  Received lines are written as-is so a capture file is
+// a replayable transcript; sent lines are prefixed with "> ".  Each file
+// begins with the config lines exchanged at startup.
+type Capture struct {
+	Dir      string
+	Redact   bool
+	Keep     int
+	preamble []string
+	sessions map[string]*captureSession
+}
+
+type captureSession struct {
+	file     *os.File
+	inHeader map[string]bool
+}
+
+func NewCapture(dir string, redact bool, keep int) (*Capture, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return &Capture{
+		Dir:      dir,
+		Redact:   redact,
+		Keep:     keep,
+		preamble: []string{},
+		sessions: make(map[string]*captureSession),
+	}, nil
+}
+
+// EnableCapture writes a transcript of each session to a file in dir
+func (f *Filter) EnableCapture(dir string, redact bool, keep int) error {
+	capture, err := NewCapture(dir, redact, keep)
+	if err != nil {
+		return err
+	}
+	f.capture = capture
+	return nil
+}
+
+// Received records a line read from smtpd
+func (c *Capture) Received(line string) {
+	atoms := strings.Split(line, "|")
+	if atoms[0] == "config" || len(atoms) <= FID_SID {
+		c.preamble = append(c.preamble, line)
+		return
+	}
+	sid := atoms[FID_SID]
+	if atoms[0] == "filter" && len(atoms) > 7 && atoms[FID_NAME] == "data-line" {
+		c.dataLine(sid, "<", line, lastAtom(line, atoms, 7))
+	} else {
+		c.write(sid, line)
+	}
+	if atoms[0] == "report" && atoms[FID_NAME] == "link-disconnect" {
+		c.closeSession(sid)
+	}
+}
+
+// Sent records a line written to smtpd
+func (c *Capture) Sent(line string) {
+	atoms := strings.SplitN(line, "|", 4)
+	if atoms[0] == "filter-dataline" && len(atoms) == 4 {
+		c.dataLine(atoms[1], ">", "> "+line, atoms[3])
+		return
+	}
+	if len(c.sessions) == 0 {
+		c.preamble = append(c.preamble, "> "+line)
+		return
+	}
+	for sid := range c.sessions {
+		c.write(sid, "> "+line)
+	}
+}
+
+// write a data-line, omitting message body lines when redacting
+func (c *Capture) dataLine(sid, direction, line, data string) {
+	session := c.session(sid)
+	if session == nil {
+		return
+	}
+	inHeader, ok := session.inHeader[direction]
+	if !ok {
+		inHeader = true
+	}
+	switch {
+	case data == ".":
+		session.inHeader[direction] = true
+	case inHeader && strings.TrimSpace(data) == "":
+		session.inHeader[direction] = false
+	case !inHeader && c.Redact:
+		return
+	}
+	c.write(sid, line)
+}
+
+func (c *Capture) session(sid string) *captureSession {
+	session, ok := c.sessions[sid]
+	if ok {
+		return session
+	}
+	filename := filepath.Join(c.Dir, fmt.Sprintf("%s-%s.txt", time.Now().Format("20060102T150405.000000"), sid))
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		slog.Warn("capture failed", "error", err)
+		return nil
+	}
+	session = &captureSession{file: file, inHeader: make(map[string]bool)}
+	c.sessions[sid] = session
+	for _, line := range c.preamble {
+		fmt.Fprintln(file, line)
+	}
+	c.prune()
+	return session
+}
+
+func (c *Capture) write(sid, line string) {
+	session := c.session(sid)
+	if session == nil {
+		return
+	}
+	_, err := fmt.Fprintln(session.file, line)
+	if err != nil {
+		slog.Warn("capture write failed", "session", sid, "error", err)
+	}
+}
+
+func (c *Capture) closeSession(sid string) {
+	session, ok := c.sessions[sid]
+	if !ok {
+		return
+	}
+	err := session.file.Close()
+	if err != nil {
+		slog.Warn("capture close failed", "session", sid, "error", err)
+	}
+	delete(c.sessions, sid)
+}
+
+// Close closes all open session files
+func (c *Capture) Close() {
+	for sid := range c.sessions {
+		c.closeSession(sid)
+	}
+}
+
+// remove the oldest capture files in excess of Keep; files of sessions
+// still open are kept
+func (c *Capture) prune() {
+	if c.Keep <= 0 {
+		return
+	}
+	files, err := filepath.Glob(filepath.Join(c.Dir, "*-*.txt"))
+	if err != nil {
+		slog.Warn("capture prune failed", "error", err)
+		return
+	}
+	sort.Strings(files)
+	excess := len(files) - c.Keep
+	for _, file := range files {
+		if excess <= 0 {
+			break
+		}
+		_, sid, _ := strings.Cut(strings.TrimSuffix(filepath.Base(file), ".txt"), "-")
+		if _, open := c.sessions[sid]; open {
+			continue
+		}
+		err := os.Remove(file)
+		if err != nil {
+			slog.Warn("capture prune failed", "error", err)
+		}
+		excess--
+	}
+}
+
+// captureWriter passes filter output through to smtpd, recording each line
+type captureWriter struct {
+	writer  io.Writer
+	capture *Capture
+	partial string
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	lines := strings.Split(w.partial+string(data), "\n")
+	w.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		w.capture.Sent(line)
+	}
+	return w.writer.Write(data)
+}
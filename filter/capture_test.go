@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	dir := t.TempDir()
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Capture", "captured")
+	require.Nil(t, f.EnableCapture(dir, true, 10))
+	replayTranscript(t, f)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*-deadbeef.txt"))
+	require.Nil(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.Nil(t, err)
+	log.Println(string(data))
+	capture := string(data)
+	require.True(t, strings.HasPrefix(capture, "config|smtpd-version|7.7.0\n"))
+	require.Contains(t, capture, "> register|ready\n")
+	require.Contains(t, capture, "|data-line|deadbeef|baadf00d|Subject: filter test message\n")
+	require.Contains(t, capture, "> filter-dataline|deadbeef|baadf00d|X-Capture: captured\n")
+	require.Contains(t, capture, "> filter-dataline|deadbeef|baadf00d|.\n")
+	require.NotContains(t, capture, "first message body line")
+
+	// the capture file is itself a replayable transcript
+	replayed, err := ReadTranscript(strings.NewReader(capture))
+	require.Nil(t, err)
+	result := Replay(NewFilter(nil, nil), replayed)
+	require.Len(t, result.Messages, 1)
+}
+
+func TestCapturePruneOpenSessions(t *testing.T) {
+	dir := t.TempDir()
+	capture, err := NewCapture(dir, false, 1)
+	require.Nil(t, err)
+	defer capture.Close()
+	report := func(sid, event string) {
+		capture.Received("report|0.7|1700000000.000000|smtp-in|" + event + "|" + sid + "|args")
+	}
+	sessionFiles := func() []string {
+		files, err := filepath.Glob(filepath.Join(dir, "*.txt"))
+		require.Nil(t, err)
+		sids := []string{}
+		for _, file := range files {
+			_, sid, _ := strings.Cut(strings.TrimSuffix(filepath.Base(file), ".txt"), "-")
+			sids = append(sids, sid)
+		}
+		return sids
+	}
+	report("aaaa", "link-connect")
+	report("bbbb", "link-connect")
+	require.ElementsMatch(t, []string{"aaaa", "bbbb"}, sessionFiles())
+	report("aaaa", "link-disconnect")
+	report("cccc", "link-connect")
+	require.ElementsMatch(t, []string{"bbbb", "cccc"}, sessionFiles())
+}
@@ -0,0 +1,114 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// control clients that stop reading replies are disconnected after this long
+const CONTROL_WRITE_TIMEOUT = 10 * time.Second
+
+// ServeControl starts a unix socket listener accepting admin commands, one
+// per line.  Each response is followed by a line containing 'ok' or 'error: '
+// and the error message.
+func (f *Filter) ServeControl(path string) (net.Listener, error) {
+	err := os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					f.log.Error("control listener failed", "error", err)
+				}
+				return
+			}
+			go f.controlSession(conn)
+		}
+	}()
+	f.log.Info("control socket listening", "path", path)
+	return listener, nil
+}
+
+// controlSession reads commands from a control client; each reply is
+// built before it is written so no filter lock is held while a slow
+// client reads it
+func (f *Filter) controlSession(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		command := strings.Fields(scanner.Text())
+		if len(command) == 0 {
+			continue
+		}
+		f.log.Info("control command", "command", strings.Join(command, " "))
+		var reply bytes.Buffer
+		err := f.Control(&reply, command[0], command[1:]...)
+		if err != nil {
+			fmt.Fprintf(&reply, "error: %v\n", err)
+		} else {
+			fmt.Fprintln(&reply, "ok")
+		}
+		conn.SetWriteDeadline(time.Now().Add(CONTROL_WRITE_TIMEOUT))
+		_, err = conn.Write(reply.Bytes())
+		if err != nil {
+			f.log.Warn("control reply failed", "error", err)
+			return
+		}
+	}
+}
+
+// Control executes an admin command, writing its output to w
+func (f *Filter) Control(w io.Writer, command string, args ...string) error {
+	switch command {
+	case "sessions":
+		f.lock.Lock()
+		state := FormatJSON(f.Sessions)
+		f.lock.Unlock()
+		_, err := fmt.Fprintln(w, state)
+		return err
+	case "rules":
+		_, err := fmt.Fprintln(w, FormatJSON(f.Rules()))
+		return err
+	case "reload":
+		return f.Reload()
+	case "verbose":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: verbose on|off")
+		}
+		switch args[0] {
+		case "on":
+			f.level.Set(slog.LevelDebug)
+		case "off":
+			// restore the configured level
+			f.level.Set(f.logLevel)
+		default:
+			return fmt.Errorf("usage: verbose on|off")
+		}
+		f.log.Info("log level changed", "level", f.level.Level().String())
+		return nil
+	case "help":
+		_, err := fmt.Fprintln(w, "commands: sessions, rules, reload, verbose on|off")
+		return err
+	}
+	return fmt.Errorf("unknown command '%s'", command)
+}
@@ -0,0 +1,108 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func controlCommand(t *testing.T, socket, command string) ([]string, string) {
+	conn, err := net.Dial("unix", socket)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = fmt.Fprintln(conn, command)
+	require.Nil(t, err)
+	lines := []string{}
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "ok" || strings.HasPrefix(line, "error: ") {
+			return lines, line
+		}
+		lines = append(lines, line)
+	}
+	require.Nil(t, scanner.Err())
+	t.Fatalf("no response to %s", command)
+	return nil, ""
+}
+
+func TestControl(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	transcript := readTranscript(t)
+	ViperSet("log-level", "warn")
+	defer ViperSet("log-level", "")
+
+	var output bytes.Buffer
+	f := NewFilter(nil, &output)
+	f.AddHeader("X-Control", "controlled")
+	require.Nil(t, f.swapRules())
+	socket := filepath.Join(t.TempDir(), "control.sock")
+	listener, err := f.ServeControl(socket)
+	require.Nil(t, err)
+	defer listener.Close()
+	for _, line := range transcript {
+		if strings.Contains(line, "link-disconnect") {
+			break
+		}
+		f.handleLine(line)
+	}
+
+	lines, status := controlCommand(t, socket, "sessions")
+	require.Equal(t, "ok", status)
+	var sessions map[string]*Session
+	require.Nil(t, json.Unmarshal([]byte(strings.Join(lines, "\n")), &sessions))
+	require.Contains(t, sessions, "deadbeef")
+	require.Equal(t, "authuser", sessions["deadbeef"].AuthorizedUser)
+	require.Equal(t, "commit", sessions["deadbeef"].Messages["cafebabe"].State)
+
+	lines, status = controlCommand(t, socket, "rules")
+	require.Equal(t, "ok", status)
+	require.Contains(t, strings.Join(lines, "\n"), "X-Control")
+
+	_, status = controlCommand(t, socket, "reload")
+	require.Equal(t, "ok", status)
+
+	_, status = controlCommand(t, socket, "verbose on")
+	require.Equal(t, "ok", status)
+	require.Equal(t, slog.LevelDebug, f.level.Level())
+	_, status = controlCommand(t, socket, "verbose off")
+	require.Equal(t, "ok", status)
+	require.Equal(t, slog.LevelWarn, f.level.Level())
+
+	_, status = controlCommand(t, socket, "verbose maybe")
+	require.True(t, strings.HasPrefix(status, "error: "))
+	_, status = controlCommand(t, socket, "bogus")
+	require.Equal(t, "error: unknown command 'bogus'", status)
+
+	// a client that stops reading replies does not block protocol lines
+	conn, err := net.Dial("unix", socket)
+	require.Nil(t, err)
+	defer conn.Close()
+	go func() {
+		for range 10000 {
+			_, err := fmt.Fprintln(conn, "sessions")
+			if err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	handled := make(chan bool)
+	go func() {
+		f.handleLine(transcript[len(transcript)-1])
+		handled <- true
+	}()
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("protocol line blocked by control client")
+	}
+}
@@ -0,0 +1,276 @@
+package filter
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// headers signed when present, in addition to the headers added by the filter
+var dkimDefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIMKey is the signing key and selector for a sender domain
+type DKIMKey struct {
+	Domain    string
+	Selector  string
+	Algorithm string
+	Signer    crypto.Signer
+}
+
+// LoadDKIMKey reads a PEM encoded RSA or Ed25519 private key
+func LoadDKIMKey(domain, selector, keyFile string) (*DKIMKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", keyFile)
+	}
+	var key any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM type '%s'", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewDKIMKey(domain, selector, key)
+}
+
+func NewDKIMKey(domain, selector string, key any) (*DKIMKey, error) {
+	dkimKey := DKIMKey{Domain: strings.ToLower(domain), Selector: selector}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		dkimKey.Algorithm = "rsa-sha256"
+		dkimKey.Signer = k
+	case ed25519.PrivateKey:
+		dkimKey.Algorithm = "ed25519-sha256"
+		dkimKey.Signer = k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return &dkimKey, nil
+}
+
+// sign returns the signature of a SHA-256 hash
+func (k *DKIMKey) sign(hash []byte) ([]byte, error) {
+	if k.Algorithm == "ed25519-sha256" {
+		return k.Signer.Sign(rand.Reader, hash, crypto.Hash(0))
+	}
+	return k.Signer.Sign(rand.Reader, hash, crypto.SHA256)
+}
+
+// buildDKIM reads the dkim config list; each entry has a domain, selector and key_file
+func (r *RuleSet) buildDKIM() []error {
+	errs := []error{}
+	r.DKIMKeys = make(map[string]*DKIMKey)
+	r.DKIMHeaders = ViperGetStringSlice("dkim-header")
+	if len(r.DKIMHeaders) == 0 {
+		r.DKIMHeaders = dkimDefaultHeaders
+	}
+	config := ViperGet("dkim")
+	if config == nil {
+		return errs
+	}
+	entries, ok := config.([]any)
+	if !ok {
+		return []error{&ConfigError{"dkim", fmt.Sprintf("%v", config), fmt.Errorf("expected a list of keys")}}
+	}
+	for _, entry := range entries {
+		fields, ok := entry.(map[string]any)
+		if !ok {
+			errs = append(errs, &ConfigError{"dkim", fmt.Sprintf("%v", entry), fmt.Errorf("expected a key mapping")})
+			continue
+		}
+		domain, _ := fields["domain"].(string)
+		selector, _ := fields["selector"].(string)
+		keyFile, _ := fields["key_file"].(string)
+		if domain == "" || selector == "" || keyFile == "" {
+			errs = append(errs, &ConfigError{"dkim", fmt.Sprintf("%v", entry), fmt.Errorf("domain, selector and key_file are required")})
+			continue
+		}
+		key, err := LoadDKIMKey(domain, selector, keyFile)
+		if err != nil {
+			errs = append(errs, &ConfigError{"dkim." + domain, keyFile, err})
+			continue
+		}
+		r.DKIMKeys[key.Domain] = key
+	}
+	return errs
+}
+
+// DKIMKey returns the signing key for the message sender domain, or nil
+func (r *RuleSet) DKIMKey(message *Message) *DKIMKey {
+	_, domain, ok := strings.Cut(message.From, "@")
+	if !ok {
+		return nil
+	}
+	return r.DKIMKeys[strings.ToLower(domain)]
+}
+
+var whitespace = regexp.MustCompile(`[ \t]+`)
+
+// relaxedHeader returns the relaxed canonical form of a header field
+func relaxedHeader(field []string) string {
+	name, value, _ := strings.Cut(strings.Join(field, ""), ":")
+	value = strings.TrimSpace(whitespace.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value + "\r\n"
+}
+
+// relaxedBody returns the relaxed canonical form of the body lines
+func relaxedBody(lines []string) []byte {
+	end := len(lines)
+	for end > 0 && strings.TrimRight(lines[end-1], " \t") == "" {
+		end--
+	}
+	var b strings.Builder
+	for _, line := range lines[:end] {
+		b.WriteString(strings.TrimRight(whitespace.ReplaceAllString(line, " "), " "))
+		b.WriteString("\r\n")
+	}
+	return []byte(b.String())
+}
+
+// splitMessage returns the header and body lines of an unstuffed message
+func splitMessage(lines []string) ([]string, []string) {
+	for i, line := range lines {
+		if line == "" {
+			return lines[:i], lines[i+1:]
+		}
+	}
+	return lines, []string{}
+}
+
+// selectHeaders returns the canonical header fields for names, taking
+// repeated names from the bottom of the header up as RFC 6376 requires
+func selectHeaders(fields [][]string, names []string) string {
+	used := make(map[int]bool)
+	var b strings.Builder
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				b.WriteString(relaxedHeader(fields[i]))
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+// signedNames returns the names from candidates present in the header, in
+// the order given, each repeated for every occurrence
+func signedNames(fields [][]string, candidates []string) []string {
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, candidate := range candidates {
+		if seen[strings.ToLower(candidate)] {
+			continue
+		}
+		seen[strings.ToLower(candidate)] = true
+		for _, field := range fields {
+			if strings.EqualFold(fieldName(field), candidate) {
+				names = append(names, candidate)
+			}
+		}
+	}
+	return names
+}
+
+// bodyHash returns the base64 SHA-256 hash of the relaxed canonical body
+func bodyHash(body []string) string {
+	hash := sha256.Sum256(relaxedBody(body))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// foldTags returns the lines of a tag list header field, ending with an empty b= tag
+func foldTags(name string, tags []string) []string {
+	lines := []string{}
+	line := name + ":"
+	for _, tag := range append(tags, "b=") {
+		if len(line)+len(tag)+1 > 78 && strings.HasSuffix(line, ";") {
+			lines = append(lines, line)
+			line = "\t" + tag
+			continue
+		}
+		line += " " + tag
+	}
+	return append(lines, line)
+}
+
+// signHeaderField signs the selected header fields followed by the folded
+// signature field with an empty b= tag, returning the signed field lines
+func signHeaderField(key *DKIMKey, name string, tags []string, selected string) ([]string, error) {
+	field := foldTags(name, tags)
+	hash := sha256.Sum256([]byte(selected + strings.TrimSuffix(relaxedHeader(field), "\r\n")))
+	signature, err := key.sign(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	b := base64.StdEncoding.EncodeToString(signature)
+	for len(b) > 0 {
+		n := min(len(b), 72)
+		field = append(field, "\t"+b[:n])
+		b = b[n:]
+	}
+	return field, nil
+}
+
+// DKIMSign returns the DKIM-Signature header field lines for an unstuffed message
+func DKIMSign(key *DKIMKey, lines []string, candidates []string, timestamp time.Time) ([]string, error) {
+	header, body := splitMessage(lines)
+	fields := headerFields(header)
+	names := signedNames(fields, candidates)
+	tags := []string{
+		"v=1;",
+		"a=" + key.Algorithm + ";",
+		"c=relaxed/relaxed;",
+		"d=" + key.Domain + ";",
+		"s=" + key.Selector + ";",
+		fmt.Sprintf("t=%d;", timestamp.Unix()),
+		"h=" + strings.Join(names, ":") + ";",
+		"bh=" + bodyHash(body) + ";",
+	}
+	return signHeaderField(key, "DKIM-Signature", tags, selectHeaders(fields, names))
+}
+
+// dkimSign prepends a DKIM-Signature to the buffered message lines
+func (f *Filter) dkimSign(log *slog.Logger, message *Message, lines []string) []string {
+	key := message.Rules.DKIMKey(message)
+	candidates := append(append([]string{}, message.Rules.DKIMHeaders...), message.Rules.OwnHeaders()...)
+	signature, err := DKIMSign(key, unstuffLines(lines), candidates, time.Now())
+	if err != nil {
+		log.Error("DKIM signing failed", "rule", "dkim", "domain", key.Domain, "error", err)
+		return lines
+	}
+	if message.Rules.IsDryRun("dkim") {
+		log.Info("dry-run: header not added", "rule", "dkim", "action", "add-header", "header", "DKIM-Signature", "domain", key.Domain, "selector", key.Selector, "dry_run", true)
+		message.Actions = append(message.Actions, Action{"dkim", "dry-run add-header", "DKIM-Signature d=" + key.Domain + " s=" + key.Selector})
+		f.Metrics.dryRun("dkim", "add-header")
+		return lines
+	}
+	log.Info("header added", "rule", "dkim", "action", "add-header", "header", "DKIM-Signature", "domain", key.Domain, "selector", key.Selector)
+	message.Actions = append(message.Actions, Action{"dkim", "add-header", "DKIM-Signature d=" + key.Domain + " s=" + key.Selector})
+	f.Metrics.headerAdded("dkim", "DKIM-Signature")
+	message.audit.addHeader("dkim", signature)
+	return append(signature, lines...)
+}
@@ -0,0 +1,89 @@
+package filter
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRelaxedCanonicalization(t *testing.T) {
+	require.Equal(t, "subject:hello world\r\n", relaxedHeader([]string{"SUBJECT :  hello ", "\t world  "}))
+	require.Equal(t, "ba9n1+9lNwnhI0hHwMNsWO7X2DbNQhRDuO7M9/QVoPM=", bodyHash([]string{"body  line  ", "", "second", "", ""}))
+	require.Equal(t, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", bodyHash([]string{"", ""}))
+}
+
+func writeKey(t *testing.T, key any) string {
+	data, err := x509.MarshalPKCS8PrivateKey(key)
+	require.Nil(t, err)
+	filename := filepath.Join(t.TempDir(), "key.pem")
+	require.Nil(t, os.WriteFile(filename, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: data}), 0600))
+	return filename
+}
+
+func TestDKIMSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	ViperSet("dkim", []any{
+		map[string]any{"domain": "example.org", "selector": "rsa", "key_file": writeKey(t, rsaKey)},
+		map[string]any{"domain": "example.net", "selector": "ed", "key_file": writeKey(t, edKey)},
+	})
+	defer ViperSet("dkim", nil)
+
+	message, err := ReadMessage(strings.NewReader("From: fromuser@example.org\nSubject: signed\n\nbody  line  \n\nsecond\n"))
+	require.Nil(t, err)
+	env := Envelope{From: "fromuser@example.org", To: []string{"touser@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+
+	for _, domain := range []string{"example.org", "example.net"} {
+		env.From = "fromuser@" + domain
+		f := NewFilter(nil, nil)
+		f.AddHeader("X-Tag", "tagged")
+		result, err := Simulate(f, &env, message)
+		require.Nil(t, err)
+		header, _ := splitMessage(result.Lines)
+		fields := headerFields(header)
+		signature := fields[0]
+		require.Equal(t, "DKIM-Signature", fieldName(signature))
+		value := fieldValue(signature)
+		require.Contains(t, value, "d="+domain+";")
+		require.Contains(t, value, "c=relaxed/relaxed;")
+		require.Contains(t, value, "h=From:Subject:X-Tag;")
+		require.Contains(t, value, "bh=ba9n1+9lNwnhI0hHwMNsWO7X2DbNQhRDuO7M9/QVoPM=;")
+		require.Equal(t, []Action{
+			{"headers", "add-header", "X-Tag: tagged"},
+			{"dkim", "add-header", "DKIM-Signature d=" + domain + " s=" + map[string]string{"example.org": "rsa", "example.net": "ed"}[domain]},
+		}, result.Actions)
+
+		// verify the signature over the canonical signed headers
+		b := regexp.MustCompile(`b=([A-Za-z0-9+/= \t]+)$`).FindStringSubmatch(strings.Join(signature, ""))
+		require.NotNil(t, b)
+		sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(b[1]), ""))
+		require.Nil(t, err)
+		unsigned := strings.TrimSuffix(relaxedHeader([]string{strings.TrimSuffix(strings.Join(signature, ""), b[1])}), "\r\n")
+		data := relaxedHeader(fields[1]) + relaxedHeader(fields[2]) + relaxedHeader(fields[3]) + unsigned
+		hash := sha256.Sum256([]byte(data))
+		if domain == "example.org" {
+			require.Nil(t, rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, hash[:], sig))
+		} else {
+			require.True(t, ed25519.Verify(edPublic, hash[:], sig))
+		}
+	}
+
+	env.From = "fromuser@example.com"
+	result, err := Simulate(NewFilter(nil, nil), &env, message)
+	require.Nil(t, err)
+	require.Equal(t, message, result.Lines)
+}
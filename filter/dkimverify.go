@@ -0,0 +1,403 @@
+package filter
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// at most this many signatures are verified per message
+const DKIM_MAX_SIGNATURES = 5
+
+// DKIMResult is the outcome of verifying one DKIM-Signature
+type DKIMResult struct {
+	Result   string
+	Reason   string
+	Domain   string
+	Selector string
+	B        string
+}
+
+// String formats the result as an Authentication-Results resinfo
+func (r *DKIMResult) String() string {
+	s := "dkim=" + r.Result
+	if r.Reason != "" {
+		s += " (" + r.Reason + ")"
+	}
+	if r.Domain != "" {
+		s += " header.d=" + r.Domain
+	}
+	if r.Selector != "" {
+		s += " header.s=" + r.Selector
+	}
+	if r.B != "" {
+		s += " header.b=" + r.B[:min(len(r.B), 8)]
+	}
+	return s
+}
+
+// parseTags parses a DKIM tag=value list
+func parseTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		if strings.TrimSpace(tag) == "" {
+			continue
+		}
+		key, val, ok := strings.Cut(tag, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed tag '%s'", strings.TrimSpace(tag))
+		}
+		key = strings.TrimSpace(key)
+		if _, ok := tags[key]; ok {
+			return nil, fmt.Errorf("duplicate tag '%s'", key)
+		}
+		tags[key] = strings.TrimSpace(val)
+	}
+	return tags, nil
+}
+
+func removeWhitespace(value string) string {
+	return strings.Join(strings.Fields(value), "")
+}
+
+// simpleHeader returns the simple canonical form of a header field
+func simpleHeader(field []string) string {
+	return strings.Join(field, "\r\n") + "\r\n"
+}
+
+// simpleBody returns the simple canonical form of the body lines
+func simpleBody(lines []string) []byte {
+	end := len(lines)
+	for end > 0 && lines[end-1] == "" {
+		end--
+	}
+	if end == 0 {
+		return []byte("\r\n")
+	}
+	return []byte(strings.Join(lines[:end], "\r\n") + "\r\n")
+}
+
+// removeSignatureValue returns the field with the b= tag value removed
+func removeSignatureValue(field []string) []string {
+	joined := strings.Join(field, "\r\n")
+	start := -1
+	for i := 0; i < len(joined)-1; i++ {
+		if joined[i] == 'b' && joined[i+1] == '=' {
+			j := i - 1
+			for j >= 0 && strings.ContainsRune(" \t\r\n", rune(joined[j])) {
+				j--
+			}
+			if j < 0 || joined[j] == ';' || joined[j] == ':' {
+				start = i + 2
+				break
+			}
+		}
+	}
+	if start < 0 {
+		return field
+	}
+	end := strings.IndexByte(joined[start:], ';')
+	if end < 0 {
+		joined = joined[:start]
+	} else {
+		joined = joined[:start] + joined[start+end:]
+	}
+	return strings.Split(joined, "\r\n")
+}
+
+// dkimPublicKey looks up the public key record for a selector and domain
+func dkimPublicKey(ctx context.Context, resolver Resolver, selector, domain, algorithm string) (crypto.PublicKey, *DKIMResult) {
+	records, err := resolver.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, &DKIMResult{Result: "permerror", Reason: "no key for signature"}
+		}
+		return nil, &DKIMResult{Result: "temperror", Reason: "key lookup failed"}
+	}
+	if len(records) == 0 {
+		return nil, &DKIMResult{Result: "permerror", Reason: "no key for signature"}
+	}
+	tags, err := parseTags(strings.Join(records, ""))
+	if err != nil {
+		return nil, &DKIMResult{Result: "permerror", Reason: "malformed key record"}
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, &DKIMResult{Result: "permerror", Reason: "unsupported key version"}
+	}
+	keyType := tags["k"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	if keyType+"-sha256" != algorithm {
+		return nil, &DKIMResult{Result: "permerror", Reason: "key type mismatch"}
+	}
+	data, err := base64.StdEncoding.DecodeString(removeWhitespace(tags["p"]))
+	if err != nil {
+		return nil, &DKIMResult{Result: "permerror", Reason: "malformed public key"}
+	}
+	if len(data) == 0 {
+		return nil, &DKIMResult{Result: "permerror", Reason: "key revoked"}
+	}
+	if keyType == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, &DKIMResult{Result: "permerror", Reason: "malformed public key"}
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	key, err := x509.ParsePKIXPublicKey(data)
+	if err != nil {
+		key, err = x509.ParsePKCS1PublicKey(data)
+		if err != nil {
+			return nil, &DKIMResult{Result: "permerror", Reason: "malformed public key"}
+		}
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, &DKIMResult{Result: "permerror", Reason: "key type mismatch"}
+	}
+	return rsaKey, nil
+}
+
+// verifyDKIMSignature verifies one DKIM-Signature field of an unstuffed message
+func verifyDKIMSignature(ctx context.Context, resolver Resolver, fields [][]string, body []string, signature []string, now time.Time) *DKIMResult {
+	tags, err := parseTags(fieldValue(signature))
+	if err != nil {
+		return &DKIMResult{Result: "permerror", Reason: err.Error()}
+	}
+	result := &DKIMResult{Domain: tags["d"], Selector: tags["s"], B: removeWhitespace(tags["b"])}
+	fail := func(kind, reason string) *DKIMResult {
+		result.Result = kind
+		result.Reason = reason
+		return result
+	}
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return fail("permerror", "missing "+tag+"= tag")
+		}
+	}
+	if tags["v"] != "1" {
+		return fail("permerror", "unsupported version")
+	}
+	names := strings.Split(removeWhitespace(tags["h"]), ":")
+	from := false
+	for _, name := range names {
+		if strings.EqualFold(name, "From") {
+			from = true
+		}
+	}
+	if !from {
+		return fail("permerror", "From field not signed")
+	}
+	if tags["x"] != "" {
+		expires, err := strconv.ParseInt(tags["x"], 10, 64)
+		if err != nil {
+			return fail("permerror", "malformed x= tag")
+		}
+		if now.Unix() > expires {
+			return fail("fail", "signature expired")
+		}
+	}
+	result.Result, result.Reason = verifyMessageSignature(ctx, resolver, tags, fields, body, signature)
+	return result
+}
+
+// verifyMessageSignature verifies the body hash and the header signature
+// of a DKIM-Signature or ARC-Message-Signature field with parsed tags
+func verifyMessageSignature(ctx context.Context, resolver Resolver, tags map[string]string, fields [][]string, body []string, signature []string) (string, string) {
+	algorithm := tags["a"]
+	if algorithm != "rsa-sha256" && algorithm != "ed25519-sha256" {
+		return "permerror", "unsupported algorithm"
+	}
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if headerCanon == "" {
+		headerCanon = "simple"
+	}
+	if bodyCanon == "" {
+		bodyCanon = "simple"
+	}
+	if (headerCanon != "simple" && headerCanon != "relaxed") || (bodyCanon != "simple" && bodyCanon != "relaxed") {
+		return "permerror", "unsupported canonicalization"
+	}
+
+	var canonicalBody []byte
+	if bodyCanon == "relaxed" {
+		canonicalBody = relaxedBody(body)
+	} else {
+		canonicalBody = simpleBody(body)
+	}
+	if tags["l"] != "" {
+		length, err := strconv.Atoi(tags["l"])
+		if err != nil || length < 0 || length > len(canonicalBody) {
+			return "permerror", "malformed l= tag"
+		}
+		canonicalBody = canonicalBody[:length]
+	}
+	hash := sha256.Sum256(canonicalBody)
+	if base64.StdEncoding.EncodeToString(hash[:]) != removeWhitespace(tags["bh"]) {
+		return "fail", "body hash did not verify"
+	}
+
+	canonical := relaxedHeader
+	if headerCanon == "simple" {
+		canonical = simpleHeader
+	}
+	used := make(map[int]bool)
+	var data strings.Builder
+	for _, name := range strings.Split(removeWhitespace(tags["h"]), ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				data.WriteString(canonical(fields[i]))
+				break
+			}
+		}
+	}
+	data.WriteString(strings.TrimSuffix(canonical(removeSignatureValue(signature)), "\r\n"))
+	return verifyHash(ctx, resolver, tags, data.String())
+}
+
+// verifyHash verifies the b= signature of the signed header data with the
+// public key of the s= and d= tags
+func verifyHash(ctx context.Context, resolver Resolver, tags map[string]string, data string) (string, string) {
+	key, keyResult := dkimPublicKey(ctx, resolver, tags["s"], tags["d"], tags["a"])
+	if keyResult != nil {
+		return keyResult.Result, keyResult.Reason
+	}
+	hash := sha256.Sum256([]byte(data))
+	sig, err := base64.StdEncoding.DecodeString(removeWhitespace(tags["b"]))
+	if err != nil {
+		return "permerror", "malformed signature"
+	}
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hash[:], sig) {
+			err = fmt.Errorf("invalid signature")
+		}
+	}
+	if err != nil {
+		return "fail", "signature did not verify"
+	}
+	return "pass", ""
+}
+
+// VerifyDKIM verifies the DKIM signatures of an unstuffed message
+func VerifyDKIM(ctx context.Context, resolver Resolver, lines []string, now time.Time) []*DKIMResult {
+	header, body := splitMessage(lines)
+	fields := headerFields(header)
+	results := []*DKIMResult{}
+	for _, field := range fields {
+		if strings.EqualFold(fieldName(field), "DKIM-Signature") {
+			if len(results) == DKIM_MAX_SIGNATURES {
+				break
+			}
+			results = append(results, verifyDKIMSignature(ctx, resolver, fields, body, field, now))
+		}
+	}
+	return results
+}
+
+// buildAuthentication reads the message authentication options
+func (r *RuleSet) buildAuthentication() []error {
+	r.DKIMVerify = ViperGetBool("dkim-verify") || r.DMARC
+	r.AuthServId = ViperGetString("authserv-id")
+	if r.AuthServId == "" && (r.DKIMVerify || r.SPF || r.ARCKey != nil) {
+		fqdn, err := HostFQDN()
+		if err != nil {
+			// fall back to the unqualified hostname
+			fqdn, err = os.Hostname()
+			if err != nil {
+				return []error{&ConfigError{"authserv-id", "", fmt.Errorf("failed reading hostname: %v", err)}}
+			}
+		}
+		r.AuthServId = fqdn
+	}
+	errs := []error{}
+	dnsTimeout := ViperGetInt("dns-timeout")
+	if dnsTimeout < 0 {
+		errs = append(errs, &ConfigError{"dns-timeout", strconv.Itoa(dnsTimeout), fmt.Errorf("expected seconds or 0 for no limit")})
+	}
+	r.DNSTimeout = time.Duration(dnsTimeout) * time.Second
+	authTimeout := ViperGetInt("auth-timeout")
+	if authTimeout < 0 {
+		errs = append(errs, &ConfigError{"auth-timeout", strconv.Itoa(authTimeout), fmt.Errorf("expected seconds or 0 for no limit")})
+	}
+	r.AuthTimeout = time.Duration(authTimeout) * time.Second
+	return errs
+}
+
+// dkimVerify verifies the DKIM signatures of the message as received
+func (f *Filter) dkimVerify(log *slog.Logger, message *Message) {
+	resolver, ctx, cancel := f.lookupContext(message)
+	defer cancel()
+	message.DKIMResults = VerifyDKIM(ctx, resolver, unstuffLines(message.Input), time.Now())
+	for _, result := range message.DKIMResults {
+		log.Info("DKIM verified", "rule", "dkim-verify", "result", result.Result, "reason", result.Reason, "domain", result.Domain, "selector", result.Selector)
+	}
+}
+
+// stripAuthResults removes or renames received Authentication-Results
+// headers that claim our authserv-id (RFC 8601 section 5)
+func (f *Filter) stripAuthResults(log *slog.Logger, message *Message, header []string, record *AuditRecord) []string {
+	return f.stripFields(log, message, header, record, "dkim-verify", func(field []string) bool {
+		if !strings.EqualFold(fieldName(field), "Authentication-Results") {
+			return false
+		}
+		id, _, _ := strings.Cut(fieldValue(field), ";")
+		fields := strings.Fields(id)
+		return len(fields) > 0 && strings.EqualFold(fields[0], message.Rules.AuthServId)
+	})
+}
+
+// authResults returns the DKIM, SPF and DMARC results of the message
+func authResults(message *Message) []string {
+	results := []string{}
+	if message.Verify {
+		for _, result := range message.DKIMResults {
+			results = append(results, result.String())
+		}
+		if len(results) == 0 {
+			results = append(results, "dkim=none")
+		}
+	}
+	if message.SPF != nil {
+		results = append(results, message.SPF.String())
+	}
+	if message.DMARC != nil {
+		results = append(results, message.DMARC.String())
+	}
+	return results
+}
+
+// authenticationResults prepends an Authentication-Results header with the
+// DKIM, SPF and DMARC results of the message to the output lines
+func (f *Filter) authenticationResults(log *slog.Logger, message *Message, lines []string) []string {
+	results := authResults(message)
+	header := foldHeader(fmt.Sprintf("Authentication-Results: %s; %s", message.Rules.AuthServId, strings.Join(results, "; ")))
+	detail := strings.Join(header, " ")
+	if message.Rules.IsDryRun("dkim-verify") {
+		log.Info("dry-run: header not added", "rule", "dkim-verify", "action", "add-header", "header", detail, "dry_run", true)
+		message.Actions = append(message.Actions, Action{"dkim-verify", "dry-run add-header", detail})
+		f.Metrics.dryRun("dkim-verify", "add-header")
+		return lines
+	}
+	log.Info("header added", "rule", "dkim-verify", "action", "add-header", "header", detail)
+	message.Actions = append(message.Actions, Action{"dkim-verify", "add-header", detail})
+	f.Metrics.headerAdded("dkim-verify", "Authentication-Results")
+	message.audit.addHeader("dkim-verify", header)
+	return append(stuffLines(header), lines...)
+}
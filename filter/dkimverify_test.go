@@ -0,0 +1,128 @@
+package filter
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.Nil(t, err)
+	resolver := NewMemoryResolver()
+	resolver.TXT["rsa._domainkey.example.org"] = []string{"v=DKIM1; k=rsa; ", "p=" + base64.StdEncoding.EncodeToString(rsaPublic)}
+	resolver.TXT["ed._domainkey.example.net"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPublic)}
+	resolver.TXT["revoked._domainkey.example.org"] = []string{"v=DKIM1; p="}
+
+	message := []string{"From: fromuser@example.org", "To: touser@localdomain.ext,", "\tother@localdomain.ext", "Subject: verify", "", "body  line  ", "", ""}
+	sign := func(domain, selector string, key any) []string {
+		dkimKey, err := NewDKIMKey(domain, selector, key)
+		require.Nil(t, err)
+		signature, err := DKIMSign(dkimKey, message, dkimDefaultHeaders, time.Now())
+		require.Nil(t, err)
+		return append(signature, message...)
+	}
+
+	results := VerifyDKIM(context.Background(), resolver, sign("example.org", "rsa", rsaKey), time.Now())
+	require.Len(t, results, 1)
+	require.Equal(t, "pass", results[0].Result)
+	require.True(t, strings.HasPrefix(results[0].String(), "dkim=pass header.d=example.org header.s=rsa header.b="))
+
+	results = VerifyDKIM(context.Background(), resolver, sign("example.net", "ed", edKey), time.Now())
+	require.Equal(t, "pass", results[0].Result)
+
+	signed := sign("example.org", "rsa", rsaKey)
+	signed[len(signed)-3] = "altered body"
+	results = VerifyDKIM(context.Background(), resolver, signed, time.Now())
+	require.Equal(t, "fail", results[0].Result)
+	require.Equal(t, "body hash did not verify", results[0].Reason)
+
+	signed = sign("example.org", "rsa", rsaKey)
+	for i, line := range signed {
+		if line == "Subject: verify" {
+			signed[i] = "Subject: altered"
+		}
+	}
+	results = VerifyDKIM(context.Background(), resolver, signed, time.Now())
+	require.Equal(t, "fail", results[0].Result)
+	require.Equal(t, "signature did not verify", results[0].Reason)
+
+	results = VerifyDKIM(context.Background(), resolver, sign("example.org", "missing", rsaKey), time.Now())
+	require.Equal(t, "permerror", results[0].Result)
+	results = VerifyDKIM(context.Background(), resolver, sign("example.org", "revoked", rsaKey), time.Now())
+	require.Equal(t, "key revoked", results[0].Reason)
+	require.Empty(t, VerifyDKIM(context.Background(), resolver, message, time.Now()))
+}
+
+func TestDKIMVerifyHeader(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	ViperSet("dkim-verify", true)
+	ViperSet("authserv-id", "mx.localdomain.ext")
+	defer func() {
+		ViperSet("dkim-verify", false)
+		ViperSet("authserv-id", "")
+	}()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	resolver := NewMemoryResolver()
+	resolver.TXT["ed._domainkey.example.net"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))}
+	dkimKey, err := NewDKIMKey("example.net", "ed", edKey)
+	require.Nil(t, err)
+	message := []string{"From: fromuser@example.net", "Subject: verify", "", "body"}
+	signature, err := DKIMSign(dkimKey, message, dkimDefaultHeaders, time.Now())
+	require.Nil(t, err)
+
+	env := Envelope{From: "fromuser@example.net", To: []string{"touser@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+	f := NewFilter(nil, nil)
+	f.FooterText = "-- footer"
+	f.Resolver = resolver
+	result, err := Simulate(f, &env, append(signature, message...))
+	require.Nil(t, err)
+	fields := headerFields(result.Lines)
+	require.Equal(t, "Authentication-Results", fieldName(fields[0]))
+	require.True(t, strings.HasPrefix(fieldValue(fields[0]), "mx.localdomain.ext; dkim=pass header.d=example.net"), fieldValue(fields[0]))
+	require.Equal(t, signature, fields[1])
+	require.Contains(t, result.Lines, "-- footer")
+
+	f = NewFilter(nil, nil)
+	f.Resolver = resolver
+	result, err = Simulate(f, &env, message)
+	require.Nil(t, err)
+	require.Equal(t, "Authentication-Results: mx.localdomain.ext; dkim=none", result.Lines[0])
+
+	// received results claiming our authserv-id are forged
+	forged := []string{
+		"Authentication-Results: MX.localdomain.ext;",
+		" dkim=pass header.d=example.net",
+		"Authentication-Results: mx.example.net; dkim=pass header.d=example.net",
+	}
+	result, err = Simulate(f, &env, append(forged, message...))
+	require.Nil(t, err)
+	header, _ := splitMessage(result.Lines)
+	require.Equal(t, []string{
+		"Authentication-Results: mx.localdomain.ext; dkim=none",
+		"Authentication-Results: mx.example.net; dkim=pass header.d=example.net",
+		"From: fromuser@example.net",
+		"Subject: verify",
+	}, header)
+	require.Contains(t, result.Actions, Action{"dkim-verify", "remove-header", "Authentication-Results: MX.localdomain.ext; dkim=pass header.d=example.net"})
+
+	// messages from internal sessions are not verified
+	internal := env
+	internal.AuthUser = "authuser"
+	result, err = Simulate(f, &internal, append(forged, message...))
+	require.Nil(t, err)
+	require.Equal(t, append(forged, message...), result.Lines)
+}
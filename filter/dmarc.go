@@ -0,0 +1,219 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/mail"
+	"strings"
+)
+
+// at most this many labels of the From: domain are used for the DMARC tree walk
+const DMARC_MAX_LABELS = 8
+
+// DMARC result values
+var dmarcResults = []string{"none", "pass", "fail", "temperror", "permerror"}
+
+// DMARCResult is the outcome of the DMARC check of the RFC 5322 From: domain
+type DMARCResult struct {
+	Result string
+	Reason string
+	Domain string
+	Policy string
+}
+
+// String formats the result as an Authentication-Results resinfo
+func (r *DMARCResult) String() string {
+	s := "dmarc=" + r.Result
+	comments := []string{}
+	if r.Policy != "" {
+		comments = append(comments, "p="+r.Policy)
+	}
+	if r.Reason != "" {
+		comments = append(comments, r.Reason)
+	}
+	if len(comments) > 0 {
+		s += " (" + strings.Join(comments, " ") + ")"
+	}
+	if r.Domain != "" {
+		s += " header.from=" + r.Domain
+	}
+	return s
+}
+
+// dmarcRecord is a published DMARC policy
+type dmarcRecord struct {
+	Domain    string
+	Policy    string
+	SubPolicy string
+	ADKIM     string
+	ASPF      string
+	PSD       bool
+}
+
+// dmarcLookup returns the DMARC record of the domain, or nil if it has none
+func dmarcLookup(ctx context.Context, resolver Resolver, domain string) (*dmarcRecord, error) {
+	records, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, record := range records {
+		if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(record)), "v=dmarc1") {
+			continue
+		}
+		tags, err := parseTags(record)
+		if err != nil || tags["v"] != "DMARC1" {
+			continue
+		}
+		policy := strings.ToLower(tags["p"])
+		if policy != "none" && policy != "quarantine" && policy != "reject" {
+			// records without a valid policy are ignored
+			continue
+		}
+		r := &dmarcRecord{Domain: domain, Policy: policy, SubPolicy: policy, ADKIM: "r", ASPF: "r"}
+		if sp := strings.ToLower(tags["sp"]); sp == "none" || sp == "quarantine" || sp == "reject" {
+			r.SubPolicy = sp
+		}
+		if strings.ToLower(tags["adkim"]) == "s" {
+			r.ADKIM = "s"
+		}
+		if strings.ToLower(tags["aspf"]) == "s" {
+			r.ASPF = "s"
+		}
+		r.PSD = strings.ToLower(tags["psd"]) == "y"
+		return r, nil
+	}
+	return nil, nil
+}
+
+// dmarcDiscover walks the DNS tree from the domain towards the root,
+// returning the policy record and the organizational domain
+func dmarcDiscover(ctx context.Context, resolver Resolver, domain string) (*dmarcRecord, string, error) {
+	labels := strings.Split(domain, ".")
+	candidates := []string{domain}
+	for i := max(1, len(labels)-DMARC_MAX_LABELS); i < len(labels); i++ {
+		candidates = append(candidates, strings.Join(labels[i:], "."))
+	}
+	var policy *dmarcRecord
+	organization := ""
+	for _, candidate := range candidates {
+		record, err := dmarcLookup(ctx, resolver, candidate)
+		if err != nil {
+			return nil, "", err
+		}
+		if record == nil {
+			continue
+		}
+		if policy == nil {
+			policy = record
+		}
+		if record.PSD {
+			// the organizational domain is the one below a public suffix domain
+			organization = domain
+			if n := strings.Count(candidate, ".") + 2; n < len(labels) {
+				organization = strings.Join(labels[len(labels)-n:], ".")
+			}
+			break
+		}
+		organization = candidate
+	}
+	if organization == "" {
+		organization = domain
+	}
+	return policy, organization, nil
+}
+
+// dmarcAligned returns true if the authenticated domain is aligned with
+// the From: domain in the given mode
+func dmarcAligned(domain, from, organization, mode string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == from {
+		return true
+	}
+	return mode == "r" && (domain == organization || strings.HasSuffix(domain, "."+organization))
+}
+
+// fromDomain returns the domain of the single From: header address
+func fromDomain(header []string) (string, error) {
+	values := headerValues(header, "From")
+	if len(values) != 1 {
+		return "", fmt.Errorf("%d From: fields", len(values))
+	}
+	addresses, err := mail.ParseAddressList(values[0])
+	if err != nil {
+		return "", fmt.Errorf("unparsable From: field")
+	}
+	domain := ""
+	for _, address := range addresses {
+		_, d, _ := strings.Cut(address.Address, "@")
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if domain != "" && d != domain {
+			return "", fmt.Errorf("multiple From: domains")
+		}
+		domain = d
+	}
+	if domain == "" {
+		return "", fmt.Errorf("no From: domain")
+	}
+	return domain, nil
+}
+
+// CheckDMARC evaluates the DMARC policy of the From: domain of the header
+// against the DKIM and SPF results
+func CheckDMARC(ctx context.Context, resolver Resolver, header []string, dkim []*DKIMResult, spf *SPFResult) *DMARCResult {
+	domain, err := fromDomain(header)
+	if err != nil {
+		return &DMARCResult{Result: "permerror", Reason: err.Error()}
+	}
+	result := &DMARCResult{Domain: domain}
+	policy, organization, err := dmarcDiscover(ctx, resolver, domain)
+	if err != nil {
+		result.Result = "temperror"
+		result.Reason = "policy lookup failed"
+		return result
+	}
+	if policy == nil {
+		result.Result = "none"
+		return result
+	}
+	result.Policy = policy.Policy
+	if policy.Domain != domain {
+		result.Policy = policy.SubPolicy
+	}
+	for _, r := range dkim {
+		if r.Result == "pass" && dmarcAligned(r.Domain, domain, organization, policy.ADKIM) {
+			result.Result = "pass"
+			result.Reason = "dkim aligned"
+			return result
+		}
+	}
+	if spf != nil && spf.Result == "pass" && dmarcAligned(spf.Domain, domain, organization, policy.ASPF) {
+		result.Result = "pass"
+		result.Reason = "spf aligned"
+		return result
+	}
+	result.Result = "fail"
+	return result
+}
+
+// buildDMARC reads the DMARC option, which also enables DKIM
+// verification and SPF
+func (r *RuleSet) buildDMARC() []error {
+	r.DMARC = ViperGetBool("dmarc")
+	if r.DMARC {
+		r.SPF = true
+	}
+	return []error{}
+}
+
+// dmarcCheck evaluates DMARC for the message header
+func (f *Filter) dmarcCheck(log *slog.Logger, message *Message, header []string) {
+	resolver, ctx, cancel := f.lookupContext(message)
+	defer cancel()
+	message.DMARC = CheckDMARC(ctx, resolver, header, message.DKIMResults, message.SPF)
+	result := message.DMARC
+	log.Info("DMARC checked", "rule", "dmarc", "result", result.Result, "reason", result.Reason, "domain", result.Domain, "policy", result.Policy)
+}
@@ -0,0 +1,139 @@
+package filter
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckDMARC(t *testing.T) {
+	resolver := NewMemoryResolver()
+	resolver.TXT["_dmarc.example.org"] = []string{"v=DMARC1; p=reject; sp=quarantine; rua=mailto:dmarc@example.org"}
+	resolver.TXT["_dmarc.strict.example.net"] = []string{"v=DMARC1; p=quarantine; adkim=s; aspf=s"}
+	resolver.TXT["_dmarc.example.net"] = []string{"v=spf1 -all"}
+	resolver.TXT["_dmarc.invalid.example.com"] = []string{"v=DMARC1; p=bogus"}
+	resolver.TXT["_dmarc.ext"] = []string{"v=DMARC1; p=none; psd=y"}
+
+	from := func(address string) []string {
+		return []string{"Subject: dmarc", "From: Sender <" + address + ">"}
+	}
+	dkim := func(domain string) []*DKIMResult {
+		return []*DKIMResult{{Result: "fail", Domain: "other.org"}, {Result: "pass", Domain: domain}}
+	}
+	spf := func(domain string) *SPFResult {
+		return &SPFResult{Result: "pass", Domain: domain}
+	}
+
+	result := CheckDMARC(context.Background(), resolver, from("user@example.org"), dkim("example.org"), nil)
+	require.Equal(t, "pass", result.Result)
+	require.Equal(t, "dmarc=pass (p=reject dkim aligned) header.from=example.org", result.String())
+
+	// relaxed alignment within the organizational domain
+	require.Equal(t, "pass", CheckDMARC(context.Background(), resolver, from("user@example.org"), dkim("mail.example.org"), nil).Result)
+	require.Equal(t, "pass", CheckDMARC(context.Background(), resolver, from("user@example.org"), nil, spf("bounce.example.org")).Result)
+
+	result = CheckDMARC(context.Background(), resolver, from("user@example.org"), dkim("example.com"), &SPFResult{Result: "fail", Domain: "example.org"})
+	require.Equal(t, "fail", result.Result)
+	require.Equal(t, "dmarc=fail (p=reject) header.from=example.org", result.String())
+
+	// subdomains use the organizational domain policy
+	result = CheckDMARC(context.Background(), resolver, from("user@news.example.org"), dkim("example.org"), nil)
+	require.Equal(t, "pass", result.Result)
+	require.Equal(t, "quarantine", result.Policy)
+
+	// strict alignment
+	require.Equal(t, "pass", CheckDMARC(context.Background(), resolver, from("user@strict.example.net"), dkim("strict.example.net"), nil).Result)
+	require.Equal(t, "fail", CheckDMARC(context.Background(), resolver, from("user@strict.example.net"), dkim("a.strict.example.net"), spf("a.strict.example.net")).Result)
+
+	// a public suffix domain record sets the organizational domain below it
+	result = CheckDMARC(context.Background(), resolver, from("user@host.localdomain.ext"), dkim("localdomain.ext"), nil)
+	require.Equal(t, "pass", result.Result)
+	require.Equal(t, "none", result.Policy)
+	require.Equal(t, "fail", CheckDMARC(context.Background(), resolver, from("user@host.localdomain.ext"), dkim("other.ext"), nil).Result)
+
+	require.Equal(t, "none", CheckDMARC(context.Background(), resolver, from("user@example.net"), dkim("example.net"), nil).Result)
+	require.Equal(t, "none", CheckDMARC(context.Background(), resolver, from("user@invalid.example.com"), nil, nil).Result)
+	require.Equal(t, "permerror", CheckDMARC(context.Background(), resolver, []string{"Subject: no from"}, nil, nil).Result)
+	require.Equal(t, "permerror", CheckDMARC(context.Background(), resolver, append(from("user@example.org"), "From: user@example.com"), nil, nil).Result)
+	require.Equal(t, "permerror", CheckDMARC(context.Background(), resolver, []string{"From: a@example.org, b@example.com"}, nil, nil).Result)
+}
+
+func TestDMARCHeader(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := `smtpd_filter_addheader:
+  dmarc: true
+  rules:
+    - name: dmarc-fail
+      header:
+        - X-DMARC-Failed=yes
+      dmarc: fail
+    - name: dmarc-prefix
+      subject_prefix: "[DMARC FAIL]"
+      dmarc: fail
+`
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	ViperSet("authserv-id", "mx.localdomain.ext")
+	defer ViperSet("authserv-id", "")
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	resolver := NewMemoryResolver()
+	resolver.TXT["ed._domainkey.example.net"] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edKey.Public().(ed25519.PublicKey))}
+	resolver.TXT["_dmarc.example.net"] = []string{"v=DMARC1; p=reject"}
+	resolver.TXT["example.net"] = []string{"v=spf1 -all"}
+	dkimKey, err := NewDKIMKey("example.net", "ed", edKey)
+	require.Nil(t, err)
+	message := []string{"From: fromuser@example.net", "Subject: dmarc", "", "body"}
+	signature, err := DKIMSign(dkimKey, message, dkimDefaultHeaders, time.Now())
+	require.Nil(t, err)
+
+	env := Envelope{From: "fromuser@example.net", To: []string{"touser@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25", Helo: "sendhost.example.net"}
+	f := NewFilter(nil, nil)
+	f.Resolver = resolver
+	result, err := Simulate(f, &env, append(signature, message...))
+	require.Nil(t, err)
+	fields := headerFields(result.Lines[:slices.Index(result.Lines, "")])
+	require.Equal(t, "Authentication-Results", fieldName(fields[0]))
+	value := fieldValue(fields[0])
+	require.True(t, strings.HasPrefix(value, "mx.localdomain.ext; dkim=pass header.d=example.net"), value)
+	require.Contains(t, value, "spf=fail (matched all of example.net) smtp.mailfrom=fromuser@example.net;")
+	require.True(t, strings.HasSuffix(value, "dmarc=pass (p=reject dkim aligned) header.from=example.net"), value)
+	require.Equal(t, "Received-SPF", fieldName(fields[1]))
+	require.Equal(t, signature, fields[2])
+	require.NotContains(t, result.Lines, "X-DMARC-Failed: yes")
+	require.Contains(t, result.Lines, "Subject: dmarc")
+
+	// an unsigned message fails and matches the rule
+	result, err = Simulate(f, &env, message)
+	require.Nil(t, err)
+	fields = headerFields(result.Lines[:slices.Index(result.Lines, "")])
+	require.True(t, strings.HasSuffix(fieldValue(fields[0]), "dmarc=fail (p=reject) header.from=example.net"), fieldValue(fields[0]))
+	require.Equal(t, []string{"X-DMARC-Failed: yes"}, fields[len(fields)-1])
+	require.Equal(t, "body", result.Lines[len(result.Lines)-1])
+
+	// failing mail gets a subject prefix, once
+	require.Contains(t, result.Lines, "Subject: [DMARC FAIL] dmarc")
+	require.Contains(t, result.Actions, Action{"dmarc-prefix", "prefix-subject", "Subject: dmarc -> Subject: [DMARC FAIL] dmarc"})
+	prefixed := []string{"From: fromuser@example.net", "Subject: [DMARC FAIL] dmarc", "", "body"}
+	result, err = Simulate(f, &env, prefixed)
+	require.Nil(t, err)
+	require.Contains(t, result.Lines, "Subject: [DMARC FAIL] dmarc")
+	folded := []string{"From: fromuser@example.net", "Subject: a long", " folded subject", "", "body"}
+	result, err = Simulate(f, &env, folded)
+	require.Nil(t, err)
+	header, _ := splitMessage(result.Lines)
+	require.Equal(t, []string{"Subject: [DMARC FAIL] a long", " folded subject"}, header[slices.Index(header, "Subject: [DMARC FAIL] a long"):][:2])
+	result, err = Simulate(f, &env, []string{"From: fromuser@example.net", "", "body"})
+	require.Nil(t, err)
+	require.Contains(t, result.Lines, "Subject: [DMARC FAIL]")
+}
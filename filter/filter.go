@@ -5,10 +5,16 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"net"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const Version = "0.0.6"
@@ -20,19 +26,47 @@ const FID_TOKEN = 6
 var Verbose bool
 
 type Message struct {
-	Id       string
-	From     string
-	To       []string
-	State    string
-	InHeader bool
+	Id          string
+	From        string
+	To          []string
+	State       string
+	InHeader    bool
+	Header      []string `json:"-"`
+	Buffered    bool
+	Verify      bool
+	Input       []string `json:"-"`
+	Output      []string `json:"-"`
+	DKIMResults []*DKIMResult
+	SPF         *SPFResult
+	DMARC       *DMARCResult
+	ARC         *ARCResult
+	Body        *BodyRewriter `json:"-"`
+	DryRunBody  *BodyRewriter `json:"-"`
+	Rules       *RuleSet      `json:"-"`
+	Actions     []Action
+
+	lookupTime time.Duration
+	audit      *AuditRecord
 }
 
-func NewMessage(mid string) *Message {
+// Action records a modification made to a message
+type Action struct {
+	Rule   string
+	Action string
+	Detail string
+}
+
+func NewMessage(mid string, rules *RuleSet) *Message {
 	return &Message{
 		Id:       mid,
 		To:       []string{},
 		State:    "init",
 		InHeader: true,
+		Header:   []string{},
+		Input:    []string{},
+		Output:   []string{},
+		Rules:    rules,
+		Actions:  []Action{},
 	}
 }
 
@@ -43,6 +77,7 @@ type Session struct {
 	Confirmed      bool
 	Remote         string
 	Local          string
+	Helo           string
 	AuthorizedUser string
 	DataMessage    string
 }
@@ -67,12 +102,33 @@ type Filter struct {
 	Name              string
 	Headers           map[string]string
 	RecipientPatterns []*regexp.Regexp
+	FooterText        string
+	FooterHTML        string
+	BannerText        string
+	BannerHTML        string
+	InternalNetworks  []*net.IPNet
 	Sessions          map[string]*Session
 	Protocol          string
 	Subsystem         string
+	OnMessage         func(*Session, *Message)
+	Metrics           *Metrics
+	Resolver          Resolver
 	reports           []string
 	filters           []string
-	verbose           bool
+	log               *slog.Logger
+	level             *slog.LevelVar
+	logLevel          slog.Level
+	rules             atomic.Pointer[RuleSet]
+	reloadLock        sync.Mutex
+	storeLock         sync.Mutex
+	store             *RuleStore
+	storeRefresh      int
+	storeStop         chan struct{}
+	lock              sync.Mutex
+	capture           *Capture
+	audit             *AuditLog
+	metricsListener   net.Listener
+	controlListener   net.Listener
 	input             *bufio.Scanner
 	output            io.Writer
 }
@@ -84,15 +140,18 @@ func NewFilter(reader io.Reader, writer io.Writer) *Filter {
 	}
 	f := Filter{
 		Name:              filepath.Base(executable),
-		verbose:           ViperGetBool("verbose"),
 		Headers:           make(map[string]string),
 		Sessions:          make(map[string]*Session),
+		Metrics:           NewMetrics(),
+		Resolver:          net.DefaultResolver,
 		RecipientPatterns: []*regexp.Regexp{},
+		InternalNetworks:  []*net.IPNet{},
 		input:             bufio.NewScanner(reader),
 		output:            writer,
 		reports: []string{
 			"link-connect",
 			"link-disconnect",
+			"link-identify",
 			"link-auth",
 			"tx-reset",
 			"tx-begin",
@@ -106,6 +165,10 @@ func NewFilter(reader io.Reader, writer io.Writer) *Filter {
 			"data-line",
 		},
 	}
+	err = f.initLogging()
+	if err != nil {
+		log.Fatal(Fatal(err))
+	}
 	return &f
 }
 
@@ -113,23 +176,35 @@ func (f *Filter) AddHeader(key, value string) {
 	f.Headers[key] = value
 }
 
-func (f *Filter) AddRecipientPattern(pattern string) {
+func (f *Filter) AddRecipientPattern(pattern string) error {
 	p, err := regexp.Compile(pattern)
 	if err != nil {
-		Warning("AddRecipientPattern(%s) failed with: %v", pattern, err)
+		return Fatalf("AddRecipientPattern(%s) failed with: %v", pattern, err)
 	}
 	f.RecipientPatterns = append(f.RecipientPatterns, p)
+	return nil
+}
+
+func (f *Filter) AddInternalNetwork(cidr string) error {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return Fatalf("AddInternalNetwork(%s) failed with: %v", cidr, err)
+	}
+	f.InternalNetworks = append(f.InternalNetworks, network)
+	return nil
 }
 
 func (f *Filter) Config() {
 	for f.input.Scan() {
 		line := f.input.Text()
-		if f.verbose {
-			log.Printf("%s config: %s\n", f.Name, line)
+		if f.capture != nil {
+			f.capture.Received(line)
 		}
+		f.log.Debug("config", "line", line)
 		fields := strings.Split(line, "|")
 		if len(fields) < 2 {
-			Warning("Config: unexpected line: %s", line)
+			f.log.Warn("unexpected config line", "line", line)
+			continue
 		}
 		switch fields[1] {
 		case "protocol":
@@ -150,36 +225,33 @@ func (f *Filter) Config() {
 func (f *Filter) Register() {
 	for _, name := range f.reports {
 		line := fmt.Sprintf("register|report|%s|%s", f.Subsystem, name)
-		log.Printf("%s.Register: %s\n", f.Name, line)
+		f.log.Debug("register", "line", line)
 		_, err := fmt.Fprintf(f.output, "%s\n", line)
 		if err != nil {
-			Warning("Register: report output failed with: %v", err)
+			f.log.Error("register report output failed", "error", err)
 		}
 	}
 	for _, name := range f.filters {
 		line := fmt.Sprintf("register|filter|%s|%s", f.Subsystem, name)
-		if f.verbose {
-			log.Printf("%s.Register: %s\n", f.Name, line)
-		}
+		f.log.Debug("register", "line", line)
 		_, err := fmt.Fprintf(f.output, "%s\n", line)
 		if err != nil {
-			Warning("Register: filter output failed with: %v", err)
+			f.log.Error("register filter output failed", "error", err)
 		}
 	}
 	line := fmt.Sprintf("register|ready")
-	if f.verbose {
-		log.Printf("%s.Register: %s\n", f.Name, line)
-	}
+	f.log.Debug("register", "line", line)
 	_, err := fmt.Fprintf(f.output, "%s\n", line)
 	if err != nil {
-		Warning("Register: ready output failed with: %v", err)
+		f.log.Error("register ready output failed", "error", err)
 	}
 
 }
 
-func requireArgs(name string, atoms []string, count int) bool {
+func (f *Filter) requireArgs(name string, atoms []string, count int) bool {
 	if len(atoms) < count {
-		Warning("%s: expected %d args, got '%v'", name, count, atoms)
+		f.log.Warn("protocol error: missing arguments", "event", name, "expected", count, "atoms", atoms)
+		f.Metrics.protocolError()
 		return false
 	}
 	return true
@@ -195,104 +267,143 @@ func lastAtom(line string, atoms []string, field int) string {
 }
 
 func (f *Filter) Run() {
-	log.Printf("Starting %s v%s\n", f.Name, Version)
-	for _, header := range ViperGetStringSlice("header") {
-		key, value, ok := strings.Cut(header, "=")
-		if !ok {
-			log.Fatal(Fatalf("invalid header config: %s", header))
+	f.log.Info("starting", "version", Version, "pid", os.Getpid(), "uid", os.Getuid(), "gid", os.Getgid())
+	err := f.swapRules()
+	if err != nil {
+		log.Fatal(Fatal(err))
+	}
+	f.watchConfig()
+	f.watchStore()
+	f.watchState()
+	if f.capture == nil && ViperGetString("capture") != "" {
+		err := f.EnableCapture(ViperGetString("capture"), ViperGetBool("capture-redact"), ViperGetInt("capture-keep"))
+		if err != nil {
+			log.Fatal(Fatal(err))
 		}
-		f.AddHeader(key, value)
 	}
-	for _, pattern := range ViperGetStringSlice("recipient") {
-		f.AddRecipientPattern(pattern)
+	if f.capture != nil {
+		f.log.Info("capturing sessions", "dir", f.capture.Dir)
+		f.output = &captureWriter{writer: f.output, capture: f.capture}
+		defer f.capture.Close()
 	}
-	if f.verbose {
-		log.Printf("pid=%d uid=%d gid=%d\n", os.Getpid(), os.Getuid(), os.Getgid())
-		for key, value := range f.Headers {
-			log.Printf("header: '%s: %s'\n", key, value)
+	if f.audit == nil && ViperGetString("audit-log") != "" {
+		err := f.EnableAudit(ViperGetString("audit-log"), ViperGetInt64("audit-max-size"), ViperGetInt("audit-keep"))
+		if err != nil {
+			log.Fatal(Fatal(err))
 		}
-		for _, pattern := range f.RecipientPatterns {
-			log.Printf("recipient pattern: `%v`\n", pattern)
+	}
+	if f.audit != nil {
+		f.log.Info("writing audit log", "file", f.audit.Path)
+		defer f.audit.Close()
+	}
+	if f.metricsListener == nil && ViperGetString("metrics-listen") != "" {
+		f.metricsListener, err = f.ServeMetrics(ViperGetString("metrics-listen"))
+		if err != nil {
+			log.Fatal(Fatal(err))
+		}
+	}
+	if f.controlListener == nil && ViperGetString("control-socket") != "" {
+		f.controlListener, err = f.ServeControl(ViperGetString("control-socket"))
+		if err != nil {
+			log.Fatal(Fatal(err))
 		}
 	}
 	f.Config()
 	f.Register()
 	for f.input.Scan() {
-		line := f.input.Text()
-		atoms := strings.Split(line, "|")
-		if len(atoms) < 6 {
-			panic("failed parsing: '" + line + "'")
-		} else {
-			switch atoms[0] {
-			case "report":
-				name := atoms[FID_NAME]
-				sid := atoms[FID_SID]
-				switch name {
-				case "link-connect":
-					if requireArgs(name, atoms, 10) {
-						f.linkConnect(name, sid, atoms[6], atoms[7], atoms[8], atoms[9])
-					}
-				case "link-disconnect":
-					f.linkDisconnect(name, sid)
-				case "link-auth":
-					if requireArgs(name, atoms, 8) {
-						f.linkAuth(name, sid, atoms[6], atoms[7])
-					}
-				case "tx-reset":
-					if requireArgs(name, atoms, 7) {
-						f.txReset(name, sid, atoms[6])
-					}
-				case "tx-begin":
-					if requireArgs(name, atoms, 7) {
-						f.txBegin(name, sid, atoms[6])
-					}
-				case "tx-mail":
-					if requireArgs(name, atoms, 9) {
-						f.txMail(name, sid, atoms[6], atoms[7], atoms[8])
-					}
-				case "tx-rcpt":
-					if requireArgs(name, atoms, 9) {
-						f.txRcpt(name, sid, atoms[6], atoms[7], atoms[8])
-					}
-				case "tx-data":
-					if requireArgs(name, atoms, 8) {
-						f.txData(name, sid, atoms[6], atoms[7])
-					}
-				case "tx-commit":
-					if requireArgs(name, atoms, 8) {
-						f.txCommit(name, sid, atoms[6], atoms[7])
-					}
-				case "tx-rollback":
-					if requireArgs(name, atoms, 7) {
-						f.txRollback(name, sid, atoms[6])
-					}
+		f.handleLine(f.input.Text())
+	}
+	err = f.input.Err()
+	if err != nil {
+		f.log.Error("input failed", "error", err)
+	}
+	f.log.Warn("unexpected EOF on stdin")
+}
+
+// handleLine processes one protocol line; state is locked against the control socket
+func (f *Filter) handleLine(line string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.capture != nil {
+		f.capture.Received(line)
+	}
+	atoms := strings.Split(line, "|")
+	if len(atoms) < 6 {
+		f.log.Warn("protocol error: unparsable line", "line", line)
+		f.Metrics.protocolError()
+	} else {
+		switch atoms[0] {
+		case "report":
+			name := atoms[FID_NAME]
+			sid := atoms[FID_SID]
+			switch name {
+			case "link-connect":
+				if f.requireArgs(name, atoms, 10) {
+					f.linkConnect(name, sid, atoms[6], atoms[7], atoms[8], atoms[9])
 				}
-			case "filter":
-				phase := atoms[FID_NAME]
-				sid := atoms[FID_SID]
-				token := atoms[FID_TOKEN]
-				switch phase {
-				case "data-line":
-					if requireArgs(phase, atoms, 8) {
-						f.dataLine(phase, sid, token, lastAtom(line, atoms, 7))
-					}
+			case "link-disconnect":
+				f.linkDisconnect(name, sid)
+			case "link-identify":
+				if f.requireArgs(name, atoms, 8) {
+					f.linkIdentify(name, sid, atoms[6], atoms[7])
+				}
+			case "link-auth":
+				if f.requireArgs(name, atoms, 8) {
+					f.linkAuth(name, sid, atoms[6], atoms[7])
+				}
+			case "tx-reset":
+				if f.requireArgs(name, atoms, 7) {
+					f.txReset(name, sid, atoms[6])
+				}
+			case "tx-begin":
+				if f.requireArgs(name, atoms, 7) {
+					f.txBegin(name, sid, atoms[6])
+				}
+			case "tx-mail":
+				if f.requireArgs(name, atoms, 9) {
+					f.txMail(name, sid, atoms[6], atoms[7], atoms[8])
+				}
+			case "tx-rcpt":
+				if f.requireArgs(name, atoms, 9) {
+					f.txRcpt(name, sid, atoms[6], atoms[7], atoms[8])
+				}
+			case "tx-data":
+				if f.requireArgs(name, atoms, 8) {
+					f.txData(name, sid, atoms[6], atoms[7])
+				}
+			case "tx-commit":
+				if f.requireArgs(name, atoms, 8) {
+					f.txCommit(name, sid, atoms[6], atoms[7])
+				}
+			case "tx-rollback":
+				if f.requireArgs(name, atoms, 7) {
+					f.txRollback(name, sid, atoms[6])
+				}
+			}
+		case "filter":
+			phase := atoms[FID_NAME]
+			sid := atoms[FID_SID]
+			token := atoms[FID_TOKEN]
+			switch phase {
+			case "data-line":
+				if f.requireArgs(phase, atoms, 8) {
+					start := time.Now()
+					f.dataLine(phase, sid, token, lastAtom(line, atoms, 7))
+					f.Metrics.dataLine(time.Since(start))
 				}
-			default:
-				Warning("unexpected input: %v", line)
 			}
+		default:
+			f.log.Warn("protocol error: unexpected input", "line", line)
+			f.Metrics.protocolError()
 		}
 	}
-	err := f.input.Err()
-	if err != nil {
-		Warning("input failed with: %v", err)
-	}
-	Warning("%s: unexpected EOF on stdin", f.Name)
 }
 
 func (f *Filter) getSession(name, sid string) *Session {
 	session, ok := f.Sessions[sid]
 	if !ok {
-		Warning("%s: unknown session: %s", name, sid)
+		f.log.Warn("unknown session", "event", name, "session", sid)
+		f.Metrics.unknownSession()
 		return nil
 
 	}
@@ -306,7 +417,7 @@ func (f *Filter) getSessionMessage(name, sid, mid string) (*Session, *Message) {
 	}
 	message, ok := session.Messages[mid]
 	if !ok {
-		Warning("%s: session %s unknown messageId: %s", name, sid, mid)
+		f.log.Warn("unknown message", "event", name, "session", sid, "message", mid)
 		return nil, nil
 	}
 	return session, message
@@ -320,29 +431,34 @@ func parseArgs(name string, args []string) (string, string, string, string) {
 }
 
 func (f *Filter) linkConnect(name, sid, rdns, confirmed, src, dst string) {
-	if f.verbose {
-		log.Printf("%s.%s: session=%s rdns=%s confirmed=%s src=%s dst=%s\n", f.Name, name, sid, rdns, confirmed, src, dst)
-	}
+	f.log.Debug("report", "event", name, "session", sid, "rdns", rdns, "confirmed", confirmed, "src", src, "dst", dst)
 	_, ok := f.Sessions[sid]
 	if ok {
-		Warning("%s.%s: existing session: %s", f.Name, name, sid)
+		f.log.Warn("existing session", "event", name, "session", sid)
 		return
 	}
 	f.Sessions[sid] = NewSession(sid, rdns, confirmed == "pass", src, dst)
+	f.Metrics.sessionOpened(len(f.Sessions))
 }
 
 func (f *Filter) linkDisconnect(name, sid string) {
-	if f.verbose {
-		log.Printf("%s.%s: session=%s\n", f.Name, name, sid)
+	f.log.Debug("report", "event", name, "session", sid)
+	if f.getSession(name, sid) != nil {
+		delete(f.Sessions, sid)
+		f.Metrics.sessionClosed(len(f.Sessions))
 	}
-	f.getSession(name, sid)
-	delete(f.Sessions, sid)
 }
 
-func (f *Filter) linkAuth(name, sid, result, username string) {
-	if f.verbose {
-		log.Printf("%s.%s: session=%s result=%s username=%s\n", f.Name, name, sid, result, username)
+func (f *Filter) linkIdentify(name, sid, method, identity string) {
+	f.log.Debug("report", "event", name, "session", sid, "method", method, "identity", identity)
+	session := f.getSession(name, sid)
+	if session != nil {
+		session.Helo = identity
 	}
+}
+
+func (f *Filter) linkAuth(name, sid, result, username string) {
+	f.log.Debug("report", "event", name, "session", sid, "result", result, "username", username)
 	session := f.getSession(name, sid)
 	if session != nil && result == "pass" {
 		session.AuthorizedUser = username
@@ -350,35 +466,29 @@ func (f *Filter) linkAuth(name, sid, result, username string) {
 }
 
 func (f *Filter) txReset(name, sid, mid string) {
-	if f.verbose {
-		log.Printf("%s.%s: session=%s message=%s\n", f.Name, name, sid, mid)
-	}
+	f.log.Debug("report", "event", name, "session", sid, "message", mid)
 	session, _ := f.getSessionMessage(name, sid, mid)
 	if session != nil {
-		session.Messages[mid] = NewMessage(mid)
+		session.Messages[mid] = NewMessage(mid, f.Rules())
 	}
 }
 
 func (f *Filter) txBegin(name, sid, mid string) {
-	if f.verbose {
-		log.Printf("%s %s: session=%s message=%s\n", f.Name, name, sid, mid)
-	}
+	f.log.Debug("report", "event", name, "session", sid, "message", mid)
 	session := f.getSession(name, sid)
 	if session == nil {
 		return
 	}
 	_, ok := session.Messages[mid]
 	if ok {
-		Warning("%s: unexpected tx-begin in session %s for existing message %s", name, sid, mid)
+		f.log.Warn("existing message", "event", name, "session", sid, "message", mid)
 		return
 	}
-	session.Messages[mid] = NewMessage(mid)
+	session.Messages[mid] = NewMessage(mid, f.Rules())
 }
 
 func (f *Filter) txMail(name, sid, mid, result, address string) {
-	if f.verbose {
-		log.Printf("%s.%s: session=%s message=%s\n", f.Name, name, sid, mid)
-	}
+	f.log.Debug("report", "event", name, "session", sid, "message", mid, "result", result, "address", address)
 	_, message := f.getSessionMessage(name, sid, mid)
 	if message != nil && result == "ok" {
 		message.From = address
@@ -386,9 +496,7 @@ func (f *Filter) txMail(name, sid, mid, result, address string) {
 }
 
 func (f *Filter) txRcpt(name, sid, mid, result, address string) {
-	if f.verbose {
-		log.Printf("%s.%s: session=%s message=%s result=%s address=%s\n", f.Name, name, sid, mid, result, address)
-	}
+	f.log.Debug("report", "event", name, "session", sid, "message", mid, "result", result, "address", address)
 	_, message := f.getSessionMessage(name, sid, mid)
 	if message != nil && result == "ok" {
 		message.To = append(message.To, address)
@@ -396,101 +504,381 @@ func (f *Filter) txRcpt(name, sid, mid, result, address string) {
 }
 
 func (f *Filter) txData(name, sid, mid, result string) {
-	if f.verbose {
-		log.Printf("%s.%s: session=%s message=%s\n", f.Name, name, sid, mid)
-	}
+	f.log.Debug("report", "event", name, "session", sid, "message", mid, "result", result)
 	session, message := f.getSessionMessage(name, sid, mid)
 	if session != nil && message != nil && result == "ok" {
 		session.DataMessage = mid
 		message.State = "data"
 		message.InHeader = true
+		rules := message.Rules
+		footer := rules.FooterText != "" || rules.FooterHTML != ""
+		banner := (rules.BannerText != "" || rules.BannerHTML != "") && rules.IsExternal(session)
+		if banner {
+			f.log.Debug("external session", "event", name, "session", sid, "message", mid, "remote", session.Remote)
+		}
+		// only messages received from external sessions are verified
+		message.Verify = rules.DKIMVerify && rules.IsExternal(session)
+		message.Buffered = rules.DKIMKey(message) != nil || message.Verify || rules.ARCKey != nil
+		message.Body = newBodyRewriter(rules, footer && !rules.IsDryRun("footer"), banner && !rules.IsDryRun("banner"))
+		message.DryRunBody = newBodyRewriter(rules, footer && rules.IsDryRun("footer"), banner && rules.IsDryRun("banner"))
 	}
 }
 
-func (f *Filter) txCommit(name, sid, mid, size string) {
-	if f.verbose {
-		log.Printf("%s.%s: session=%s message=%s size=%s\n", f.Name, name, sid, mid, size)
+// return a BodyRewriter for the selected body rules, or nil if none are selected
+func newBodyRewriter(rules *RuleSet, footer, banner bool) *BodyRewriter {
+	if !footer && !banner {
+		return nil
+	}
+	body := NewBodyRewriter("", "")
+	if footer {
+		body.FooterText = rules.FooterText
+		body.FooterHTML = rules.FooterHTML
+	}
+	if banner {
+		body.BannerText = rules.BannerText
+		body.BannerHTML = rules.BannerHTML
 	}
+	return body
+}
+
+func (f *Filter) txCommit(name, sid, mid, size string) {
+	f.log.Debug("report", "event", name, "session", sid, "message", mid, "size", size)
 	_, message := f.getSessionMessage(name, sid, mid)
 	if message != nil {
 		message.State = "commit"
+		f.Metrics.messageState(message.State)
 	}
 }
 
 func (f *Filter) txRollback(name, sid, mid string) {
-	if f.verbose {
-		log.Printf("%s.%s: session=%s message=%s\n", f.Name, name, sid, mid)
-	}
+	f.log.Debug("report", "event", name, "session", sid, "message", mid)
 	_, message := f.getSessionMessage(name, sid, mid)
 	if message != nil {
 		message.State = "rollback"
+		f.Metrics.messageState(message.State)
 	}
 }
 
 func (f *Filter) sessionTimeout(name, sid string) {
-	if f.verbose {
-		log.Printf("%s.%s: session=%s\n", f.Name, name, sid)
-	}
+	f.log.Debug("report", "event", name, "session", sid)
 	session := f.getSession(name, sid)
 	if session != nil {
 		delete(f.Sessions, sid)
+		f.Metrics.sessionClosed(len(f.Sessions))
 	}
 }
 
-func (f *Filter) recipientMatches(name string, message *Message) bool {
-	// if no patterns exist, add the header unconditionally
-	if len(f.RecipientPatterns) == 0 {
-		return true
+// recipientMatches returns true if a recipient matches one of the patterns
+// or is found in one of the tables, with a match status for the trace
+// header; the recipient and pattern are only logged, as the trace header
+// is visible to every recipient
+func (f *Filter) recipientMatches(log *slog.Logger, patterns []*regexp.Regexp, tables []*Table, message *Message) (bool, string) {
+	// if no patterns or tables exist, add the header unconditionally
+	if len(patterns) == 0 && len(tables) == 0 {
+		return true, "all"
 	}
 	// if patterns exist, only add the header if a recipient address matches
 	for _, recipient := range message.To {
-		if f.verbose {
-			log.Printf("%s.%s: checking recipient patterns for: %s\n", f.Name, name, recipient)
-		}
-		for _, pattern := range f.RecipientPatterns {
+		for _, pattern := range patterns {
 			if pattern.MatchString(recipient) {
-				if f.verbose {
-					log.Printf("%s.%s: recipient match found: %s\n", f.Name, name, recipient)
-				}
-				return true
+				log.Debug("recipient match", "recipient", recipient, "pattern", pattern.String())
+				return true, "match"
 			}
 		}
-		if f.verbose {
-			log.Printf("%s.%s: no match for recipient: %s\n", f.Name, name, recipient)
+		for _, table := range tables {
+			key, _, ok := table.LookupAddress(recipient)
+			if ok {
+				log.Debug("recipient match", "recipient", recipient, "table", table.Spec, "key", key)
+				return true, "match"
+			}
 		}
+		log.Debug("recipient no match", "recipient", recipient)
 	}
-	return false
+	return false, "no-match"
 }
 
-func (f *Filter) dataLine(name, sid, token, line string) {
-	if f.verbose {
-		log.Printf("%s.%s: sid=%s token=%s line=%s\n", f.Name, name, sid, token, line)
+// processHeader returns the complete message header with filter headers added
+func (f *Filter) processHeader(log *slog.Logger, session *Session, message *Message) []string {
+	record := NewAuditRecord(session, message)
+	message.audit = record
+	header := message.Header
+	if message.Rules.StripInbound {
+		header = f.stripInbound(log, session, message, header, record)
+	}
+	if message.Verify {
+		header = f.stripAuthResults(log, message, header, record)
+	}
+	if message.Rules.VerifySignature {
+		header = f.verifySignature(log, message, header, record)
+	}
+	if message.Rules.SPF {
+		header = f.spfCheck(log, session, message, header, record)
+	}
+	if message.Rules.DMARC && message.Verify {
+		f.dmarcCheck(log, message, header)
+	}
+	if message.Rules.SignKey != nil {
+		header = f.stripSigned(log, message, header, record)
+	}
+	header = f.addHeaders(log, session, message, header, record)
+	if message.Rules.SignKey != nil {
+		header = append(header, f.signHeaders(log, message, header, record)...)
+	}
+	if !message.Buffered {
+		// buffered messages are audited when complete
+		f.writeAudit(log, record)
+	}
+	return header
+}
+
+// addHeaders returns the header lines added by each rule matching the message
+func (f *Filter) addHeaders(log *slog.Logger, session *Session, message *Message, header []string, record *AuditRecord) []string {
+	lines := []string{}
+	add := func(rule string, dryRun bool, key, value string) {
+		header := fmt.Sprintf("%s: %s", key, value)
+		if dryRun {
+			log.Info("dry-run: header not added", "rule", rule, "action", "add-header", "header", key, "value", value, "dry_run", true)
+			message.Actions = append(message.Actions, Action{rule, "dry-run add-header", header})
+			f.Metrics.dryRun(rule, "add-header")
+			return
+		}
+		log.Info("header added", "rule", rule, "action", "add-header", "header", key, "value", value)
+		lines = append(lines, foldHeader(header)...)
+		message.Actions = append(message.Actions, Action{rule, "add-header", header})
+		f.Metrics.headerAdded(rule, key)
+		record.Added = append(record.Added, header)
+		if len(record.Rules) == 0 || record.Rules[len(record.Rules)-1] != rule {
+			record.Rules = append(record.Rules, rule)
+		}
+	}
+	trace := []string{"version=" + Version}
+	for _, rule := range message.Rules.HeaderRules() {
+		match, detail := f.recipientMatches(log.With("rule", rule.Name), rule.RecipientPatterns, rule.RecipientTables, message)
+		if match {
+			conditions, condition := rule.conditionsMatch(message)
+			if !conditions {
+				match = false
+				detail = "no-match " + condition
+			} else if condition != "" {
+				detail += " " + condition
+			}
+		}
+		if rule.DryRun {
+			detail += " (dry-run)"
+		}
+		trace = append(trace, fmt.Sprintf("%s=%s", rule.Name, detail))
+		if !match {
+			continue
+		}
+		if rule.SubjectPrefix != "" {
+			header = f.prefixSubject(log, message, header, record, rule)
+		}
+		for _, key := range rule.HeaderKeys() {
+			for _, value := range rule.HeaderValues(key, session, message) {
+				add(rule.Name, rule.DryRun, key, value)
+			}
+		}
+	}
+	rules := message.Rules
+	if rules.TraceHeader != "" {
+		match, _ := f.recipientMatches(log.With("rule", "trace"), rules.TracePatterns, nil, message)
+		if match {
+			add("trace", rules.IsDryRun("trace"), rules.TraceHeader, strings.Join(append(trace, bodyTrace(session, message)...), "; "))
+		}
+	}
+	return append(header, lines...)
+}
+
+// prefixSubject prepends the subject prefix of the rule to the Subject
+// header, adding one if the message has none; subjects that already start
+// with the prefix are unchanged
+func (f *Filter) prefixSubject(log *slog.Logger, message *Message, header []string, record *AuditRecord, rule *HeaderRule) []string {
+	fields := headerFields(header)
+	index := slices.IndexFunc(fields, func(field []string) bool {
+		return strings.EqualFold(fieldName(field), "Subject")
+	})
+	original := ""
+	changed := []string{"Subject: " + rule.SubjectPrefix}
+	if index >= 0 {
+		original = "Subject: " + fieldValue(fields[index])
+		if strings.HasPrefix(fieldValue(fields[index]), rule.SubjectPrefix) {
+			return header
+		}
+		_, value, _ := strings.Cut(fields[index][0], ":")
+		changed = append([]string{changed[0] + " " + strings.TrimLeft(value, " \t")}, fields[index][1:]...)
+	}
+	detail := original + " -> Subject: " + fieldValue(changed)
+	if rule.DryRun {
+		log.Info("dry-run: header not changed", "rule", rule.Name, "action", "prefix-subject", "header", original, "prefix", rule.SubjectPrefix, "dry_run", true)
+		message.Actions = append(message.Actions, Action{rule.Name, "dry-run prefix-subject", detail})
+		f.Metrics.dryRun(rule.Name, "prefix-subject")
+		return header
+	}
+	log.Info("header changed", "rule", rule.Name, "action", "prefix-subject", "header", original, "prefix", rule.SubjectPrefix)
+	message.Actions = append(message.Actions, Action{rule.Name, "prefix-subject", detail})
+	record.Changed = append(record.Changed, detail)
+	record.Rules = append(record.Rules, rule.Name)
+	output := []string{}
+	for i, field := range fields {
+		if i == index {
+			field = changed
+		}
+		output = append(output, field...)
+	}
+	if index < 0 {
+		output = append(output, changed...)
+	}
+	return output
+}
+
+// bodyTrace describes the body rules applied to the message
+func bodyTrace(session *Session, message *Message) []string {
+	trace := []string{}
+	rules := message.Rules
+	if rules.FooterText != "" || rules.FooterHTML != "" {
+		detail := "footer=yes"
+		if rules.IsDryRun("footer") {
+			detail += " (dry-run)"
+		}
+		trace = append(trace, detail)
+	}
+	if rules.BannerText != "" || rules.BannerHTML != "" {
+		detail := "banner=internal"
+		if rules.IsExternal(session) {
+			detail = "banner=external"
+		}
+		if rules.IsDryRun("banner") {
+			detail += " (dry-run)"
+		}
+		trace = append(trace, detail)
+	}
+	return trace
+}
+
+// foldHeader splits a long header field into continuation lines at '; ' separators
+func foldHeader(header string) []string {
+	lines := []string{}
+	line := ""
+	for _, item := range strings.SplitAfter(header, "; ") {
+		if line != "" && len(line)+len(strings.TrimSpace(item)) > 78 {
+			lines = append(lines, strings.TrimRight(line, " "))
+			line = "\t"
+		}
+		line += item
+	}
+	return append(lines, line)
+}
+
+// bufferLines holds the output lines of messages that are modified as a
+// whole, returning them with the final modifications when the message is complete
+func (f *Filter) bufferLines(name string, session *Session, line string, lines []string) []string {
+	message, ok := session.Messages[session.DataMessage]
+	if !ok || !message.Buffered {
+		return lines
+	}
+	if (message.Verify || message.Rules.ARCKey != nil) && line != "." {
+		// keep the message as received for signature verification
+		message.Input = append(message.Input, line)
 	}
+	if len(lines) == 0 || lines[len(lines)-1] != "." {
+		message.Output = append(message.Output, lines...)
+		return []string{}
+	}
+	output := append(message.Output, lines[:len(lines)-1]...)
+	message.Output = []string{}
+	log := f.log.With("event", name, "session", session.Id, "message", message.Id)
+	if message.Verify {
+		f.dkimVerify(log, message)
+	}
+	if message.Rules.DMARC && message.Verify && !message.InHeader {
+		// header processing waits for the DKIM results of the complete message
+		output = append(f.processHeader(log, session, message), output...)
+	}
+	if message.Verify {
+		output = f.authenticationResults(log, message, output)
+	}
+	if message.Rules.DKIMKey(message) != nil {
+		output = f.dkimSign(log, message, output)
+	}
+	if message.Rules.ARCKey != nil {
+		output = f.arcSeal(log, message, output)
+	}
+	if message.audit != nil {
+		f.writeAudit(log, message.audit)
+	}
+	return append(output, ".")
+}
+
+func (f *Filter) dataLine(name, sid, token, line string) {
+	f.log.Debug("filter", "event", name, "session", sid, "token", token, "line", line)
 	lines := []string{line}
 	session := f.getSession(name, sid)
 	if session != nil {
 		_, message := f.getSessionMessage(name, sid, session.DataMessage)
 		if message != nil && message.InHeader {
-			// if at end of message header lines
-			if strings.TrimSpace(line) == "" {
-				// add filter headers
-				if f.recipientMatches(name, message) {
-					lines = []string{}
-					for key, value := range f.Headers {
-						log.Printf("%s.%s: adding header '%s: %s'\n", f.Name, name, key, value)
-						lines = append(lines, fmt.Sprintf("%s: %s", key, value))
-					}
-					lines = append(lines, line)
+			log := f.log.With("event", name, "session", sid, "message", message.Id)
+			for _, body := range []*BodyRewriter{message.Body, message.DryRunBody} {
+				if body != nil && line != "." {
+					body.Header(line)
 				}
-				// mark end of header
+			}
+			switch {
+			case line == ".":
+				// message ended without a body; with DMARC the header is
+				// processed with the complete message
 				message.InHeader = false
+				if !message.Rules.DMARC || !message.Verify {
+					lines = append(f.processHeader(log, session, message), line)
+				}
+			case strings.TrimSpace(line) == "":
+				// end of message header lines; with DMARC the header is
+				// processed when the message is complete
+				if !message.Rules.DMARC || !message.Verify {
+					lines = append(f.processHeader(log, session, message), line)
+				}
+				message.InHeader = false
+			default:
+				// buffer header lines until the header is complete
+				message.Header = append(message.Header, line)
+				lines = []string{}
+			}
+		} else if message != nil {
+			log := f.log.With("event", name, "session", sid, "message", message.Id)
+			if message.DryRunBody != nil {
+				// evaluate dry-run body rules, discarding the output
+				message.DryRunBody.Line(line)
+				if line == "." {
+					for _, action := range message.DryRunBody.Actions {
+						log.Info("dry-run: body not modified", "rule", action.Rule, "action", action.Action, "part", action.Detail, "dry_run", true)
+						message.Actions = append(message.Actions, Action{action.Rule, "dry-run " + action.Action, action.Detail})
+						f.Metrics.dryRun(action.Rule, action.Action)
+					}
+				}
+			}
+			if message.Body != nil {
+				lines = message.Body.Line(line)
+				if line == "." {
+					for _, action := range message.Body.Actions {
+						log.Info("body modified", "rule", action.Rule, "action", action.Action, "part", action.Detail)
+					}
+					message.Actions = append(message.Actions, message.Body.Actions...)
+				}
 			}
 		}
 	}
+	if session != nil {
+		lines = f.bufferLines(name, session, line, lines)
+	}
 	for _, oline := range lines {
 		_, err := fmt.Fprintf(f.output, "filter-dataline|%s|%s|%s\n", sid, token, oline)
 		if err != nil {
-			Warning("failed writing data line: %v", err)
+			f.log.Error("failed writing data line", "session", sid, "error", err)
+		}
+	}
+	if line == "." && session != nil && f.OnMessage != nil {
+		_, message := f.getSessionMessage(name, sid, session.DataMessage)
+		if message != nil {
+			f.OnMessage(session, message)
 		}
 	}
 }
@@ -0,0 +1,174 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// the standard log output, captured before cmd sets the default slog logger
+var logWriter io.Writer
+var logWriterOnce sync.Once
+
+// initLogging configures leveled structured logging from the log-level,
+// log-format and log-output options.  The text format keeps the standard
+// log prefix and flags; logfmt and json write one structured record per line.
+func (f *Filter) initLogging() error {
+	logWriterOnce.Do(func() {
+		logWriter = log.Writer()
+	})
+	f.level = new(slog.LevelVar)
+	level := ViperGetString("log-level")
+	if level == "" {
+		level = "info"
+		if ViperGetBool("verbose") {
+			level = "debug"
+		}
+	}
+	err := f.level.UnmarshalText([]byte(level))
+	if err != nil {
+		return fmt.Errorf("invalid log-level '%s'", level)
+	}
+	f.logLevel = f.level.Level()
+	output := ViperGetString("log-output")
+	writer := logWriter
+	var sysLog *syslogHandler
+	switch output {
+	case "", "stderr":
+	case "syslog":
+		s, err := NewSyslog(ViperGetString("syslog-socket"), ViperGetString("syslog-facility"), f.Name)
+		if err != nil {
+			return fmt.Errorf("failed opening syslog: %v", err)
+		}
+		sysLog = &syslogHandler{state: &syslogState{syslog: s}}
+		writer = &sysLog.state.buf
+	default:
+		return fmt.Errorf("invalid log-output '%s'", output)
+	}
+	options := slog.HandlerOptions{Level: f.level}
+	var handler slog.Handler
+	switch format := ViperGetString("log-format"); format {
+	case "", "text":
+		flags := log.Flags()
+		if output == "syslog" {
+			flags = 0
+		}
+		handler = &textHandler{
+			level:  f.level,
+			logger: log.New(writer, log.Prefix(), flags),
+			attrs:  []slog.Attr{},
+		}
+	case "logfmt":
+		handler = slog.NewTextHandler(writer, &options)
+	case "json":
+		handler = slog.NewJSONHandler(writer, &options)
+	default:
+		return fmt.Errorf("invalid log-format '%s'", format)
+	}
+	if sysLog != nil {
+		sysLog.handler = handler
+		handler = sysLog
+	}
+	f.log = slog.New(handler)
+	return nil
+}
+
+// Logger returns the filter's logger; commands make it the default logger
+func (f *Filter) Logger() *slog.Logger {
+	return f.log
+}
+
+// textHandler writes records as 'LEVEL message key=value...' lines through a log.Logger
+type textHandler struct {
+	level  *slog.LevelVar
+	logger *log.Logger
+	attrs  []slog.Attr
+	group  string
+}
+
+func (h *textHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *textHandler) Handle(ctx context.Context, record slog.Record) error {
+	var buf strings.Builder
+	buf.WriteString(record.Level.String())
+	buf.WriteString(" ")
+	buf.WriteString(record.Message)
+	for _, attr := range h.attrs {
+		fmt.Fprintf(&buf, " %s=%v", attr.Key, attr.Value)
+	}
+	record.Attrs(func(attr slog.Attr) bool {
+		fmt.Fprintf(&buf, " %s%s=%v", h.group, attr.Key, attr.Value)
+		return true
+	})
+	return h.logger.Output(0, buf.String())
+}
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handler := *h
+	handler.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, attr := range attrs {
+		handler.attrs = append(handler.attrs, slog.Attr{Key: h.group + attr.Key, Value: attr.Value})
+	}
+	return &handler
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	handler := *h
+	handler.group = h.group + name + "."
+	return &handler
+}
+
+// syslogHandler formats records with the configured handler and sends each
+// one to syslog with a severity matching its level
+type syslogHandler struct {
+	handler slog.Handler
+	state   *syslogState
+}
+
+type syslogState struct {
+	syslog *Syslog
+	buf    bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func syslogSeverity(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return LOG_ERR
+	case level >= slog.LevelWarn:
+		return LOG_WARNING
+	case level >= slog.LevelInfo:
+		return LOG_INFO
+	}
+	return LOG_DEBUG
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, record slog.Record) error {
+	h.state.mutex.Lock()
+	defer h.state.mutex.Unlock()
+	h.state.buf.Reset()
+	err := h.handler.Handle(ctx, record)
+	if err != nil {
+		return err
+	}
+	return h.state.syslog.Send(syslogSeverity(record.Level), h.state.buf.String())
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{handler: h.handler.WithAttrs(attrs), state: h.state}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{handler: h.handler.WithGroup(name), state: h.state}
+}
@@ -0,0 +1,46 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogJSON(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+
+	var buf bytes.Buffer
+	logger := slog.Default()
+	NewFilter(nil, nil)
+	require.Same(t, logger, slog.Default())
+	saved := logWriter
+	logWriter = &buf
+	ViperSet("log-format", "json")
+	ViperSet("log-level", "debug")
+	defer func() {
+		logWriter = saved
+		ViperSet("log-format", "text")
+		ViperSet("log-level", "")
+	}()
+
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Log", "logged")
+	replayTranscript(t, f)
+
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		require.Nil(t, json.Unmarshal([]byte(line), &record), line)
+		require.Contains(t, record, "level")
+		require.Contains(t, record, "msg")
+		if record["event"] == "tx-commit" {
+			require.Equal(t, "deadbeef", record["session"])
+			found = true
+		}
+	}
+	require.True(t, found)
+}
@@ -0,0 +1,227 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// mapped header lookup keys
+var mappedKeys = []string{"recipient", "recipient-domain", "sender-domain", "auth-user"}
+
+// mapped header modes for messages whose recipients map to different values
+var mappedModes = []string{"first", "join", "each"}
+
+// MappedHeader takes its value from a key to value map or table, looked up
+// by recipient address, recipient domain, sender domain or auth user.
+// When recipients map to different values, mode 'first' uses the first
+// recipient's value, 'join' joins the distinct values with Separator and
+// 'each' adds one header per distinct value.  Messages with no mapped
+// value get the Default value, or no header if Default is empty.
+type MappedHeader struct {
+	Name      string
+	Key       string
+	Mode      string
+	Separator string
+	Default   string
+	Table     *Table
+	Map       map[string]string
+}
+
+func NewMappedHeader(name string) *MappedHeader {
+	return &MappedHeader{Name: name, Key: "recipient", Mode: "first", Separator: ", "}
+}
+
+// lookup returns the values of the first of the keys found in the map or table
+func (h *MappedHeader) lookup(keys []string) ([]string, bool) {
+	for _, key := range keys {
+		if h.Table != nil {
+			// a table value is one header value, commas included
+			value, ok := h.Table.Lookup(key)
+			if ok && value == "" {
+				return []string{}, true
+			}
+			if ok {
+				return []string{value}, true
+			}
+			continue
+		}
+		value, ok := h.Map[strings.ToLower(key)]
+		if ok {
+			return []string{value}, true
+		}
+	}
+	return nil, false
+}
+
+// lookupKeys returns the lookup keys for each recipient, or for the
+// sender domain or auth user
+func (h *MappedHeader) lookupKeys(session *Session, message *Message) [][]string {
+	keys := [][]string{}
+	switch h.Key {
+	case "recipient":
+		for _, recipient := range message.To {
+			keys = append(keys, addressKeys(recipient))
+		}
+	case "recipient-domain":
+		for _, recipient := range message.To {
+			_, domain, ok := strings.Cut(recipient, "@")
+			if ok {
+				keys = append(keys, []string{domain})
+			}
+		}
+	case "sender-domain":
+		_, domain, ok := strings.Cut(message.From, "@")
+		if ok {
+			keys = append(keys, []string{domain})
+		}
+	case "auth-user":
+		if session.AuthorizedUser != "" {
+			keys = append(keys, []string{session.AuthorizedUser})
+		}
+	}
+	return keys
+}
+
+// Values returns the header values for the message according to the mode
+func (h *MappedHeader) Values(session *Session, message *Message) []string {
+	values := []string{}
+	for _, keys := range h.lookupKeys(session, message) {
+		found, ok := h.lookup(keys)
+		if !ok || len(found) == 0 {
+			continue
+		}
+		if h.Mode == "first" {
+			return []string{strings.Join(found, ", ")}
+		}
+		for _, value := range found {
+			if !slices.Contains(values, value) {
+				values = append(values, value)
+			}
+		}
+	}
+	if len(values) == 0 {
+		if h.Default == "" {
+			return []string{}
+		}
+		return []string{h.Default}
+	}
+	if h.Mode == "join" {
+		return []string{strings.Join(values, h.Separator)}
+	}
+	return values
+}
+
+// MarshalJSON formats the mapped header with its table as a string
+func (h *MappedHeader) MarshalJSON() ([]byte, error) {
+	table := ""
+	if h.Table != nil {
+		table = h.Table.Spec
+	}
+	return json.Marshal(struct {
+		Key       string
+		Mode      string
+		Separator string
+		Default   string
+		Table     string            `json:",omitempty"`
+		Map       map[string]string `json:",omitempty"`
+	}{h.Key, h.Mode, h.Separator, h.Default, table, h.Map})
+}
+
+// buildMappedHeaders parses a mapped_header config list; each entry has a
+// name, a key, a table or map, and optional default, mode and separator
+func buildMappedHeaders(key string, config any, headers map[string]string, mapped map[string]*MappedHeader) []error {
+	errs := []error{}
+	if config == nil {
+		return errs
+	}
+	entries, ok := config.([]any)
+	if !ok {
+		return []error{&ConfigError{key, fmt.Sprintf("%v", config), fmt.Errorf("expected a list of mapped headers")}}
+	}
+	for _, entry := range entries {
+		fields, ok := entry.(map[string]any)
+		if !ok {
+			errs = append(errs, &ConfigError{key, fmt.Sprintf("%v", entry), fmt.Errorf("expected a mapped header mapping")})
+			continue
+		}
+		name, _ := fields["name"].(string)
+		err := ValidateHeaderName(name)
+		if err == nil {
+			err = checkMappedName(name, headers, mapped)
+		}
+		if err != nil {
+			errs = append(errs, &ConfigError{key, name, err})
+			continue
+		}
+		header := NewMappedHeader(name)
+		entryKey := key + "." + name
+		if value, ok := fields["key"].(string); ok {
+			header.Key = value
+		}
+		if !slices.Contains(mappedKeys, header.Key) {
+			errs = append(errs, &ConfigError{entryKey + ".key", header.Key, fmt.Errorf("expected one of %s", strings.Join(mappedKeys, ", "))})
+		}
+		if value, ok := fields["mode"].(string); ok {
+			header.Mode = value
+		}
+		if !slices.Contains(mappedModes, header.Mode) {
+			errs = append(errs, &ConfigError{entryKey + ".mode", header.Mode, fmt.Errorf("expected one of %s", strings.Join(mappedModes, ", "))})
+		}
+		if value, ok := fields["separator"].(string); ok {
+			header.Separator = value
+		}
+		if value, ok := fields["default"]; ok {
+			header.Default = fmt.Sprintf("%v", value)
+		}
+		table, _ := fields["table"].(string)
+		values, _ := fields["map"].(map[string]any)
+		switch {
+		case table != "" && values != nil:
+			errs = append(errs, &ConfigError{entryKey, table, fmt.Errorf("table and map are exclusive")})
+			continue
+		case table != "":
+			header.Table, err = NewTable(table)
+			if err != nil {
+				errs = append(errs, &ConfigError{entryKey + ".table", table, err})
+				continue
+			}
+		case values != nil:
+			header.Map = make(map[string]string)
+			for k, v := range values {
+				header.Map[strings.ToLower(k)] = fmt.Sprintf("%v", v)
+			}
+		default:
+			errs = append(errs, &ConfigError{entryKey, "", fmt.Errorf("table or map is required")})
+			continue
+		}
+		for _, value := range append([]string{header.Default}, header.staticValues()...) {
+			if strings.ContainsAny(value, "\r\n") {
+				errs = append(errs, &ConfigError{entryKey, value, fmt.Errorf("header value contains line break")})
+			}
+		}
+		mapped[name] = header
+	}
+	return errs
+}
+
+// staticValues returns the values of an inline map
+func (h *MappedHeader) staticValues() []string {
+	values := []string{}
+	for _, value := range h.Map {
+		values = append(values, value)
+	}
+	return values
+}
+
+// checkMappedName rejects a mapped header name already used by the rule
+func checkMappedName(name string, headers map[string]string, mapped map[string]*MappedHeader) error {
+	if _, ok := headers[name]; ok {
+		return fmt.Errorf("header also has a static value")
+	}
+	if _, ok := mapped[name]; ok {
+		return fmt.Errorf("duplicate mapped header")
+	}
+	return nil
+}
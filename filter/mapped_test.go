@@ -0,0 +1,91 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMappedHeaderValues(t *testing.T) {
+	tenants := NewMappedHeader("X-Tenant")
+	tenants.Key = "recipient-domain"
+	tenants.Default = "unknown"
+	tenants.Map = map[string]string{"alpha.ext": "alpha", "beta.ext": "beta", "also-alpha.ext": "alpha"}
+	session := &Session{}
+	values := func(mode string, to ...string) []string {
+		tenants.Mode = mode
+		return tenants.Values(session, &Message{From: "sender@example.org", To: to})
+	}
+	require.Equal(t, []string{"alpha"}, values("first", "a@alpha.ext", "b@beta.ext"))
+	require.Equal(t, []string{"beta"}, values("first", "x@other.ext", "b@beta.ext"))
+	require.Equal(t, []string{"alpha, beta"}, values("join", "a@alpha.ext", "b@beta.ext", "c@also-alpha.ext"))
+	require.Equal(t, []string{"alpha", "beta"}, values("each", "a@alpha.ext", "b@beta.ext", "c@also-alpha.ext"))
+	require.Equal(t, []string{"unknown"}, values("each", "x@other.ext"))
+	tenants.Separator = "; "
+	require.Equal(t, []string{"beta; alpha"}, values("join", "b@BETA.ext", "a@alpha.ext"))
+	tenants.Default = ""
+	require.Equal(t, []string{}, values("first", "x@other.ext"))
+
+	senders := NewMappedHeader("X-Sender-Class")
+	senders.Key = "sender-domain"
+	senders.Map = map[string]string{"example.org": "partner"}
+	require.Equal(t, []string{"partner"}, senders.Values(session, &Message{From: "sender@example.org", To: []string{"a@alpha.ext"}}))
+	require.Equal(t, []string{}, senders.Values(session, &Message{From: "", To: []string{"a@alpha.ext"}}))
+
+	users := NewMappedHeader("X-Department")
+	users.Key = "auth-user"
+	users.Map = map[string]string{"alice": "sales"}
+	require.Equal(t, []string{"sales"}, users.Values(&Session{AuthorizedUser: "alice"}, &Message{}))
+	require.Equal(t, []string{}, users.Values(session, &Message{}))
+}
+
+func TestMappedHeaderRules(t *testing.T) {
+	dir := t.TempDir()
+	owners := filepath.Join(dir, "owners")
+	require.Nil(t, os.WriteFile(owners, []byte("touser@localdomain.ext owner-a\n@localdomain.ext owner-b\n"), 0600))
+	configFile := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`smtpd_filter_addheader:
+  mapped_header:
+    - name: X-Tenant
+      key: recipient-domain
+      mode: each
+      default: none
+      map:
+        localdomain.ext: local
+        elsewhere.ext: remote
+  rules:
+    - name: owners
+      mapped_header:
+        - name: X-Owner
+          table: file:%s
+          mode: join
+`, owners)
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+
+	message := []string{"Subject: mapped", "", "body"}
+	simulate := func(recipients ...string) []string {
+		env := Envelope{From: "fromuser@example.org", To: recipients, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+		result, err := Simulate(NewFilter(nil, nil), &env, message)
+		require.Nil(t, err)
+		header, _ := splitMessage(result.Lines)
+		return header
+	}
+	require.Equal(t, []string{"Subject: mapped", "X-Tenant: local", "X-Tenant: remote", "X-Owner: owner-a, owner-b"},
+		simulate("touser@localdomain.ext", "other@elsewhere.ext", "another@localdomain.ext"))
+	require.Equal(t, []string{"Subject: mapped", "X-Tenant: none"}, simulate("other@example.org"))
+
+	require.Nil(t, os.WriteFile(configFile, []byte(`smtpd_filter_addheader:
+  mapped_header:
+    - name: X-Tenant
+      key: recipient-address
+      mode: all
+    - name: X-Other
+      key: sender-domain
+`), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	require.Len(t, NewFilter(nil, nil).CheckRules(), 4)
+}
@@ -0,0 +1,238 @@
+package filter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const METRICS_PREFIX = "smtpd_filter_addheader_"
+
+// data-line latency histogram bucket upper bounds in seconds
+var dataLineBuckets = []float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1}
+
+// Metrics counts filter activity for export in the Prometheus text format
+type Metrics struct {
+	SessionsOpened  uint64
+	SessionsClosed  uint64
+	SessionsActive  int
+	Messages        map[string]uint64
+	HeadersAdded    map[metricsHeader]uint64
+	DryRuns         map[metricsDryRun]uint64
+	ProtocolErrors  uint64
+	UnknownSessions uint64
+	DataLineCounts  []uint64
+	DataLineCount   uint64
+	DataLineSum     float64
+	mutex           sync.Mutex
+}
+
+type metricsHeader struct {
+	Rule   string
+	Header string
+}
+
+type metricsDryRun struct {
+	Rule   string
+	Action string
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Messages:       make(map[string]uint64),
+		HeadersAdded:   make(map[metricsHeader]uint64),
+		DryRuns:        make(map[metricsDryRun]uint64),
+		DataLineCounts: make([]uint64, len(dataLineBuckets)),
+	}
+}
+
+func (m *Metrics) sessionOpened(active int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.SessionsOpened++
+	m.SessionsActive = active
+}
+
+func (m *Metrics) sessionClosed(active int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.SessionsClosed++
+	m.SessionsActive = active
+}
+
+func (m *Metrics) messageState(state string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Messages[state]++
+}
+
+func (m *Metrics) headerAdded(rule, header string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.HeadersAdded[metricsHeader{rule, header}]++
+}
+
+func (m *Metrics) dryRun(rule, action string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.DryRuns[metricsDryRun{rule, action}]++
+}
+
+func (m *Metrics) protocolError() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.ProtocolErrors++
+}
+
+func (m *Metrics) unknownSession() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.UnknownSessions++
+}
+
+func (m *Metrics) dataLine(elapsed time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	seconds := elapsed.Seconds()
+	for i, bound := range dataLineBuckets {
+		if seconds <= bound {
+			m.DataLineCounts[i]++
+		}
+	}
+	m.DataLineCount++
+	m.DataLineSum += seconds
+}
+
+// MarshalJSON formats the metrics with header counts keyed by 'rule/header'
+func (m *Metrics) MarshalJSON() ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	headers := make(map[string]uint64)
+	for key, count := range m.HeadersAdded {
+		headers[key.Rule+"/"+key.Header] = count
+	}
+	dryRuns := make(map[string]uint64)
+	for key, count := range m.DryRuns {
+		dryRuns[key.Rule+"/"+key.Action] = count
+	}
+	return json.Marshal(struct {
+		SessionsOpened  uint64
+		SessionsClosed  uint64
+		SessionsActive  int
+		Messages        map[string]uint64
+		HeadersAdded    map[string]uint64
+		DryRuns         map[string]uint64
+		ProtocolErrors  uint64
+		UnknownSessions uint64
+		DataLineCount   uint64
+		DataLineSum     float64
+	}{m.SessionsOpened, m.SessionsClosed, m.SessionsActive, m.Messages, headers, dryRuns, m.ProtocolErrors, m.UnknownSessions, m.DataLineCount, m.DataLineSum})
+}
+
+// WriteText writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var b strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&b, "# HELP %s%s %s\n# TYPE %s%s %s\n", METRICS_PREFIX, name, help, METRICS_PREFIX, name, kind)
+	}
+	metric("sessions_opened_total", "counter", "SMTP sessions opened.")
+	fmt.Fprintf(&b, "%ssessions_opened_total %d\n", METRICS_PREFIX, m.SessionsOpened)
+	metric("sessions_closed_total", "counter", "SMTP sessions closed.")
+	fmt.Fprintf(&b, "%ssessions_closed_total %d\n", METRICS_PREFIX, m.SessionsClosed)
+	metric("sessions_active", "gauge", "SMTP sessions currently open.")
+	fmt.Fprintf(&b, "%ssessions_active %d\n", METRICS_PREFIX, m.SessionsActive)
+
+	metric("messages_total", "counter", "Messages by final transaction state.")
+	for _, state := range []string{"commit", "rollback"} {
+		fmt.Fprintf(&b, "%smessages_total{state=%q} %d\n", METRICS_PREFIX, state, m.Messages[state])
+	}
+
+	metric("headers_added_total", "counter", "Headers added by rule and header name.")
+	keys := make([]metricsHeader, 0, len(m.HeadersAdded))
+	for key := range m.HeadersAdded {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Rule != keys[j].Rule {
+			return keys[i].Rule < keys[j].Rule
+		}
+		return keys[i].Header < keys[j].Header
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&b, "%sheaders_added_total{rule=%q,header=%q} %d\n", METRICS_PREFIX, key.Rule, key.Header, m.HeadersAdded[key])
+	}
+
+	metric("dry_run_total", "counter", "Modifications skipped by dry-run rules, by rule and action.")
+	dryRuns := make([]metricsDryRun, 0, len(m.DryRuns))
+	for key := range m.DryRuns {
+		dryRuns = append(dryRuns, key)
+	}
+	sort.Slice(dryRuns, func(i, j int) bool {
+		if dryRuns[i].Rule != dryRuns[j].Rule {
+			return dryRuns[i].Rule < dryRuns[j].Rule
+		}
+		return dryRuns[i].Action < dryRuns[j].Action
+	})
+	for _, key := range dryRuns {
+		fmt.Fprintf(&b, "%sdry_run_total{rule=%q,action=%q} %d\n", METRICS_PREFIX, key.Rule, key.Action, m.DryRuns[key])
+	}
+
+	metric("protocol_errors_total", "counter", "Unparsable or unexpected protocol lines.")
+	fmt.Fprintf(&b, "%sprotocol_errors_total %d\n", METRICS_PREFIX, m.ProtocolErrors)
+	metric("unknown_sessions_total", "counter", "Events received for unknown sessions.")
+	fmt.Fprintf(&b, "%sunknown_sessions_total %d\n", METRICS_PREFIX, m.UnknownSessions)
+
+	metric("dataline_duration_seconds", "histogram", "Time spent processing each data-line.")
+	for i, bound := range dataLineBuckets {
+		fmt.Fprintf(&b, "%sdataline_duration_seconds_bucket{le=\"%g\"} %d\n", METRICS_PREFIX, bound, m.DataLineCounts[i])
+	}
+	fmt.Fprintf(&b, "%sdataline_duration_seconds_bucket{le=\"+Inf\"} %d\n", METRICS_PREFIX, m.DataLineCount)
+	fmt.Fprintf(&b, "%sdataline_duration_seconds_sum %g\n", METRICS_PREFIX, m.DataLineSum)
+	fmt.Fprintf(&b, "%sdataline_duration_seconds_count %d\n", METRICS_PREFIX, m.DataLineCount)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// ServeMetrics starts an HTTP listener for /metrics on a TCP address or,
+// if address begins with '/' or 'unix:', a unix socket path
+func (f *Filter) ServeMetrics(address string) (net.Listener, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") || strings.HasPrefix(address, "/") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+		err := os.Remove(address)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", f.Metrics)
+	go func() {
+		err := http.Serve(listener, mux)
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			f.log.Error("metrics listener failed", "error", err)
+		}
+	}()
+	f.log.Info("serving metrics", "network", network, "address", listener.Addr().String())
+	return listener, nil
+}
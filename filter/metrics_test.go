@@ -0,0 +1,47 @@
+package filter
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	transcript := readTranscript(t)
+
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Metrics", "counted")
+	socket := filepath.Join(t.TempDir(), "metrics.sock")
+	listener, err := f.ServeMetrics(socket)
+	require.Nil(t, err)
+	defer listener.Close()
+	Replay(f, append(transcript, "report|0.7|1.0|smtp-in|link-disconnect|feedface", "garbage"))
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return net.Dial("unix", socket)
+			},
+		},
+	}
+	response, err := client.Get("http://localhost/metrics")
+	require.Nil(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	data, err := io.ReadAll(response.Body)
+	require.Nil(t, err)
+	text := string(data)
+	require.Contains(t, text, "smtpd_filter_addheader_sessions_opened_total 1\n")
+	require.Contains(t, text, "smtpd_filter_addheader_sessions_closed_total 1\n")
+	require.Contains(t, text, "smtpd_filter_addheader_sessions_active 0\n")
+	require.Contains(t, text, "smtpd_filter_addheader_messages_total{state=\"commit\"} 1\n")
+	require.Contains(t, text, "smtpd_filter_addheader_headers_added_total{rule=\"headers\",header=\"X-Metrics\"} 1\n")
+	require.Contains(t, text, "smtpd_filter_addheader_protocol_errors_total 1\n")
+	require.Contains(t, text, "smtpd_filter_addheader_unknown_sessions_total 1\n")
+	require.Contains(t, text, "smtpd_filter_addheader_dataline_duration_seconds_bucket{le=\"+Inf\"}")
+}
@@ -0,0 +1,418 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/quotedprintable"
+	"strings"
+)
+
+const (
+	bodyPass = iota
+	bodyPartHeader
+	bodyText
+)
+
+type mimePart struct {
+	MediaType   string
+	Params      map[string]string
+	Encoding    string
+	Disposition string
+}
+
+// parse the MIME fields from a block of raw header lines
+func parseMimePart(lines []string) *mimePart {
+	part := mimePart{
+		MediaType: "text/plain",
+		Params:    map[string]string{},
+	}
+	for _, field := range unfoldHeader(lines) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "content-type":
+			mediaType, params, err := mime.ParseMediaType(value)
+			if err != nil {
+				slog.Warn("invalid Content-Type", "value", value, "error", err)
+				mediaType = "application/octet-stream"
+			}
+			part.MediaType = mediaType
+			part.Params = params
+		case "content-transfer-encoding":
+			part.Encoding = strings.ToLower(value)
+		case "content-disposition":
+			disposition, _, err := mime.ParseMediaType(value)
+			if err == nil {
+				part.Disposition = disposition
+			}
+		}
+	}
+	return &part
+}
+
+// join folded header continuation lines
+func unfoldHeader(lines []string) []string {
+	fields := []string{}
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func (p *mimePart) isMultipart() bool {
+	return strings.HasPrefix(p.MediaType, "multipart/")
+}
+
+func (p *mimePart) charsetOK(text string) bool {
+	switch strings.ToLower(p.Params["charset"]) {
+	case "utf-8", "utf8":
+		return true
+	}
+	return isASCII(text)
+}
+
+func isASCII(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// BodyRewriter tracks the MIME structure of a message as the data-lines
+// stream past, buffering the first text/plain and text/html parts so that
+// a banner can be prepended and a footer appended.  Everything else is
+// passed through unmodified.
+type BodyRewriter struct {
+	FooterText string
+	FooterHTML string
+	BannerText string
+	BannerHTML string
+	state      int
+	header     []string
+	boundaries []string
+	part       *mimePart
+	partHeader []string
+	buffer     []string
+	modified   map[string]bool
+	Actions    []Action
+}
+
+func NewBodyRewriter(footerText, footerHTML string) *BodyRewriter {
+	return &BodyRewriter{
+		FooterText: footerText,
+		FooterHTML: footerHTML,
+		header:     []string{},
+		boundaries: []string{},
+		modified:   make(map[string]bool),
+		Actions:    []Action{},
+	}
+}
+
+// Header accepts the top-level message header lines; the blank line ends the header
+func (r *BodyRewriter) Header(line string) {
+	if strings.TrimSpace(line) != "" {
+		r.header = append(r.header, line)
+		return
+	}
+	part := parseMimePart(r.header)
+	r.header = []string{}
+	r.beginPart(part, []string{})
+}
+
+// Line accepts a body data-line, returning the lines to be output in its place
+func (r *BodyRewriter) Line(line string) []string {
+	if line == "." {
+		if r.state == bodyPartHeader {
+			// the message ended in a part header; output it unchanged
+			lines := r.header
+			r.header = []string{}
+			r.state = bodyPass
+			return append(lines, line)
+		}
+		return append(r.flush(), line)
+	}
+	if r.state == bodyPartHeader {
+		r.header = append(r.header, line)
+		if strings.TrimSpace(line) == "" {
+			lines := r.header
+			r.header = []string{}
+			return r.beginPart(parseMimePart(lines), lines)
+		}
+		return []string{}
+	}
+	level, closing := r.matchBoundary(line)
+	if level >= 0 {
+		lines := r.flush()
+		if closing {
+			r.boundaries = r.boundaries[:level]
+			r.state = bodyPass
+		} else {
+			r.boundaries = r.boundaries[:level+1]
+			r.state = bodyPartHeader
+		}
+		return append(lines, line)
+	}
+	if r.state == bodyText {
+		r.buffer = append(r.buffer, line)
+		return []string{}
+	}
+	return []string{line}
+}
+
+// return the index of the enclosing multipart whose boundary matches line, or -1
+func (r *BodyRewriter) matchBoundary(line string) (int, bool) {
+	if !strings.HasPrefix(line, "--") {
+		return -1, false
+	}
+	line = strings.TrimRight(line, " \t")
+	for i := len(r.boundaries) - 1; i >= 0; i-- {
+		delimiter := "--" + r.boundaries[i]
+		switch line {
+		case delimiter:
+			return i, false
+		case delimiter + "--":
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// set state for a part whose header has been read, returning the header lines to output
+func (r *BodyRewriter) beginPart(part *mimePart, header []string) []string {
+	r.part = part
+	r.state = bodyPass
+	switch {
+	case part.MediaType == "multipart/signed":
+		// opaque; passed through until an enclosing boundary
+	case part.isMultipart():
+		boundary, ok := part.Params["boundary"]
+		if ok && boundary != "" {
+			r.boundaries = append(r.boundaries, boundary)
+		} else {
+			slog.Warn("multipart part has no boundary", "type", part.MediaType)
+		}
+	case part.Disposition == "attachment" || r.modified[part.MediaType]:
+	case part.MediaType == "text/plain" && (r.FooterText != "" || r.BannerText != ""):
+		r.state = bodyText
+	case part.MediaType == "text/html" && (r.FooterHTML != "" || r.BannerHTML != ""):
+		r.state = bodyText
+	}
+	if r.state == bodyText {
+		r.partHeader = header
+		r.buffer = []string{}
+		return []string{}
+	}
+	return header
+}
+
+// output the buffered text part with the banner and footer added
+func (r *BodyRewriter) flush() []string {
+	if r.state != bodyText {
+		return []string{}
+	}
+	r.state = bodyPass
+	r.modified[r.part.MediaType] = true
+	header := r.partHeader
+	lines := r.buffer
+	r.partHeader = []string{}
+	r.buffer = []string{}
+
+	html := r.part.MediaType == "text/html"
+	banner, footer := r.BannerText, r.FooterText
+	if html {
+		banner, footer = r.BannerHTML, r.FooterHTML
+	}
+	encoding := r.part.Encoding
+	if !r.part.charsetOK(banner + footer) {
+		slog.Warn("body part not modified: unsupported charset", "type", r.part.MediaType, "charset", r.part.Params["charset"])
+		return append(header, lines...)
+	}
+
+	content, err := decodeBody(r.part.Encoding, unstuffLines(lines))
+	if err != nil {
+		slog.Warn("body part not modified: decoding failed", "type", r.part.MediaType, "error", err)
+		return append(header, lines...)
+	}
+	if banner != "" && (bannerPresent(content, r.BannerText) || bannerPresent(content, banner)) {
+		banner = ""
+	}
+	if banner == "" && footer == "" {
+		return append(header, lines...)
+	}
+	if !isASCII(banner+footer) && (encoding == "" || encoding == "7bit") {
+		if len(header) == 0 {
+			slog.Warn("body part not modified: 7bit message body", "type", r.part.MediaType)
+			return append(header, lines...)
+		}
+		encoding = "quoted-printable"
+		header = setTransferEncoding(header, encoding)
+	}
+	if html {
+		content = insertHTML(content, banner, footer)
+	} else {
+		content = insertText(content, banner, footer)
+	}
+	if banner != "" {
+		r.Actions = append(r.Actions, Action{"banner", "add-banner", r.part.MediaType})
+	}
+	if footer != "" {
+		r.Actions = append(r.Actions, Action{"footer", "add-footer", r.part.MediaType})
+	}
+	return append(header, stuffLines(encodeBody(encoding, content))...)
+}
+
+// report whether content already contains the banner, ignoring whitespace and quoting
+func bannerPresent(content, banner string) bool {
+	if strings.TrimSpace(banner) == "" {
+		return false
+	}
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimLeft(line, "> \t")
+	}
+	normalized := strings.Join(strings.Fields(strings.Join(lines, "\n")), " ")
+	return strings.Contains(normalized, strings.Join(strings.Fields(banner), " "))
+}
+
+// replace or add the Content-Transfer-Encoding field in a block of part header lines
+func setTransferEncoding(header []string, encoding string) []string {
+	field := "Content-Transfer-Encoding: " + encoding
+	lines := []string{}
+	skipping := false
+	for _, line := range header {
+		if skipping && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			continue
+		}
+		skipping = false
+		key, _, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(key), "content-transfer-encoding") {
+			skipping = true
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, field)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func newline(content string) string {
+	if strings.Contains(content, "\r\n") {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+func insertText(content, banner, footer string) string {
+	nl := newline(content)
+	if banner != "" {
+		content = strings.ReplaceAll(strings.TrimRight(banner, "\r\n"), "\n", nl) + nl + content
+	}
+	if footer != "" {
+		content = strings.TrimSuffix(strings.TrimSuffix(content, "\n"), "\r")
+		content += nl + strings.ReplaceAll(strings.TrimRight(footer, "\r\n"), "\n", nl) + nl
+	}
+	return content
+}
+
+func insertHTML(content, banner, footer string) string {
+	nl := newline(content)
+	lower := strings.ToLower(content)
+	if banner != "" {
+		index := strings.Index(lower, "<body")
+		if index >= 0 && strings.Contains(lower[index:], ">") {
+			index += strings.Index(lower[index:], ">") + 1
+			content = content[:index] + nl + banner + content[index:]
+		} else {
+			content = insertText(content, banner, "")
+		}
+		lower = strings.ToLower(content)
+	}
+	if footer != "" {
+		for _, tag := range []string{"</body>", "</html>"} {
+			index := strings.LastIndex(lower, tag)
+			if index >= 0 {
+				return content[:index] + footer + nl + content[index:]
+			}
+		}
+		content = insertText(content, "", footer)
+	}
+	return content
+}
+
+func decodeBody(encoding string, lines []string) (string, error) {
+	switch encoding {
+	case "quoted-printable":
+		reader := quotedprintable.NewReader(strings.NewReader(strings.Join(lines, "\r\n") + "\r\n"))
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case "base64":
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(strings.Join(lines, "")), ""))
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+func encodeBody(encoding, content string) []string {
+	switch encoding {
+	case "quoted-printable":
+		var buf bytes.Buffer
+		writer := quotedprintable.NewWriter(&buf)
+		writer.Write([]byte(content))
+		writer.Close()
+		content = buf.String()
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString([]byte(content))
+		lines := []string{}
+		for len(encoded) > 76 {
+			lines = append(lines, encoded[:76])
+			encoded = encoded[76:]
+		}
+		return append(lines, encoded)
+	}
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// remove SMTP dot-stuffing from data-lines
+func unstuffLines(lines []string) []string {
+	ret := make([]string, len(lines))
+	for i, line := range lines {
+		ret[i] = strings.TrimPrefix(line, ".")
+	}
+	return ret
+}
+
+// apply SMTP dot-stuffing to data-lines
+func stuffLines(lines []string) []string {
+	ret := make([]string, len(lines))
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		ret[i] = line
+	}
+	return ret
+}
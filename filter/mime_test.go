@@ -0,0 +1,218 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func rewriteMessage(r *BodyRewriter, lines []string) []string {
+	output := []string{}
+	inHeader := true
+	for _, line := range lines {
+		if inHeader {
+			r.Header(line)
+			output = append(output, line)
+			inHeader = strings.TrimSpace(line) != ""
+			continue
+		}
+		output = append(output, r.Line(line)...)
+	}
+	return output
+}
+
+func TestFooterPlain(t *testing.T) {
+	r := NewBodyRewriter("-- \nlegal disclaimer", "<p>legal disclaimer</p>")
+	output := rewriteMessage(r, []string{
+		"Subject: plain",
+		"",
+		"body line",
+		"..dot stuffed line",
+		".",
+	})
+	log.Println(FormatJSON(output))
+	require.Equal(t, []string{
+		"Subject: plain",
+		"",
+		"body line",
+		"..dot stuffed line",
+		"-- ",
+		"legal disclaimer",
+		".",
+	}, output)
+}
+
+func TestFooterAlternative(t *testing.T) {
+	r := NewBodyRewriter("disclaimer é", "<p>disclaimer</p>")
+	output := rewriteMessage(r, []string{
+		"Subject: alternative",
+		"Content-Type: multipart/alternative;",
+		"\tboundary=\"XYZ\"",
+		"",
+		"preamble",
+		"--XYZ",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"caf=C3=A9",
+		"--XYZ",
+		"Content-Type: text/html; charset=utf-8",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"PGh0bWw+PGJvZHk+aGVsbG88L2JvZHk+PC9odG1sPg==",
+		"--XYZ--",
+		"epilogue",
+		".",
+	})
+	log.Println(FormatJSON(output))
+	require.Contains(t, output, "caf=C3=A9")
+	require.Contains(t, output, "disclaimer =C3=A9")
+	require.Contains(t, output, "PGh0bWw+PGJvZHk+aGVsbG88cD5kaXNjbGFpbWVyPC9wPgo8L2JvZHk+PC9odG1sPg==")
+	require.Equal(t, "--XYZ--", output[len(output)-3])
+}
+
+func TestFooterTruncated(t *testing.T) {
+	message := []string{
+		"Subject: truncated",
+		"Content-Type: multipart/mixed; boundary=\"XYZ\"",
+		"",
+		"--XYZ",
+		"Content-Type: application/octet-stream",
+		"",
+		"AAAA",
+		"--XYZ",
+		"Content-Type: text/plain",
+	}
+	// a message ending in a part header is output unchanged
+	truncated := append(message, "Content-Transfer-Encoding: 7bit", ".")
+	require.Equal(t, truncated, rewriteMessage(NewBodyRewriter("footer", ""), truncated))
+
+	// a text part without a closing boundary is completed
+	output := rewriteMessage(NewBodyRewriter("footer", ""), append(message, "", "unterminated", "."))
+	require.Equal(t, append(message, "", "unterminated", "footer", "."), output)
+}
+
+func TestFooterSevenBit(t *testing.T) {
+	r := NewBodyRewriter("disclaimer é", "")
+	output := rewriteMessage(r, []string{
+		"Content-Type: multipart/mixed; boundary=outer",
+		"",
+		"--outer",
+		"Content-Type: text/plain; charset=utf-8",
+		"",
+		"hello",
+		"--outer",
+		"Content-Type: text/plain",
+		"Content-Disposition: attachment; filename=notes.txt",
+		"",
+		"attached",
+		"--outer--",
+		".",
+	})
+	log.Println(FormatJSON(output))
+	require.Equal(t, []string{
+		"Content-Type: multipart/mixed; boundary=outer",
+		"",
+		"--outer",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"hello",
+		"disclaimer =C3=A9",
+		"--outer",
+		"Content-Type: text/plain",
+		"Content-Disposition: attachment; filename=notes.txt",
+		"",
+		"attached",
+		"--outer--",
+		".",
+	}, output)
+}
+
+func TestFooterSigned(t *testing.T) {
+	r := NewBodyRewriter("disclaimer", "<p>disclaimer</p>")
+	input := []string{
+		"Content-Type: multipart/signed; protocol=\"application/pgp-signature\"; boundary=sig",
+		"",
+		"--sig",
+		"Content-Type: text/plain",
+		"",
+		"signed content",
+		"--sig",
+		"Content-Type: application/pgp-signature",
+		"",
+		"signature",
+		"--sig--",
+		".",
+	}
+	require.Equal(t, input, rewriteMessage(r, input))
+}
+
+func TestBanner(t *testing.T) {
+	r := NewBodyRewriter("", "")
+	r.BannerText = "CAUTION: external sender"
+	r.BannerHTML = "<p>CAUTION: external sender</p>"
+	output := rewriteMessage(r, []string{
+		"Content-Type: multipart/alternative; boundary=alt",
+		"",
+		"--alt",
+		"Content-Type: text/plain",
+		"",
+		"hello",
+		"--alt",
+		"Content-Type: text/html",
+		"",
+		"<html><body class=\"x\">hello</body></html>",
+		"--alt--",
+		".",
+	})
+	log.Println(FormatJSON(output))
+	require.Equal(t, []string{
+		"Content-Type: multipart/alternative; boundary=alt",
+		"",
+		"--alt",
+		"Content-Type: text/plain",
+		"",
+		"CAUTION: external sender",
+		"hello",
+		"--alt",
+		"Content-Type: text/html",
+		"",
+		"<html><body class=\"x\">",
+		"<p>CAUTION: external sender</p>hello</body></html>",
+		"--alt--",
+		".",
+	}, output)
+}
+
+func TestBannerIdempotent(t *testing.T) {
+	r := NewBodyRewriter("", "")
+	r.BannerText = "CAUTION: external\nsender"
+	input := []string{
+		"Subject: Fwd: forwarded",
+		"",
+		"see below",
+		"> CAUTION: external",
+		"> sender",
+		"> original message",
+		".",
+	}
+	require.Equal(t, input, rewriteMessage(r, input))
+}
+
+func TestExternalSession(t *testing.T) {
+	f := &Filter{Name: "test", InternalNetworks: []*net.IPNet{}}
+	require.Nil(t, f.AddInternalNetwork("10.0.0.0/8"))
+	require.Nil(t, f.AddInternalNetwork("fd00::/8"))
+	require.NotNil(t, f.AddInternalNetwork("10.0.0.0/33"))
+	rules := RuleSet{InternalNetworks: f.InternalNetworks}
+	require.True(t, rules.IsExternal(NewSession("1", "", true, "1.2.3.4:11223", "")))
+	require.False(t, rules.IsExternal(NewSession("2", "", true, "10.1.2.3:11223", "")))
+	require.False(t, rules.IsExternal(NewSession("3", "", true, "[fd00::1]:11223", "")))
+	require.False(t, rules.IsExternal(NewSession("4", "", true, "unix:/var/run/smtpd.sock", "")))
+	session := NewSession("5", "", true, "1.2.3.4:11223", "")
+	session.AuthorizedUser = "authuser"
+	require.False(t, rules.IsExternal(session))
+}
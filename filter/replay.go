@@ -0,0 +1,204 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+)
+
+// ReplayMessage holds the data-lines sent to and returned by the filter for one message
+type ReplayMessage struct {
+	Session string
+	Token   string
+	Input   []string
+	Output  []string
+}
+
+// ReplayResult is the complete filter output and the per-message data-lines
+type ReplayResult struct {
+	Output   []string
+	Messages []*ReplayMessage
+}
+
+// ReadTranscript returns the protocol lines of a captured filter input stream
+func ReadTranscript(reader io.Reader) ([]string, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		for _, prefix := range []string{"config|", "report|", "filter|"} {
+			if strings.HasPrefix(line, prefix) {
+				lines = append(lines, line)
+				break
+			}
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		if line == "config|ready" {
+			return lines, nil
+		}
+	}
+	return nil, fmt.Errorf("transcript has no config|ready line")
+}
+
+// Replay runs the transcript through the filter, capturing its output
+func Replay(f *Filter, transcript []string) *ReplayResult {
+	var output bytes.Buffer
+	f.input = bufio.NewScanner(strings.NewReader(strings.Join(transcript, "\n") + "\n"))
+	f.input.Buffer(make([]byte, 64*1024), 1024*1024)
+	f.output = &output
+	f.Run()
+
+	result := ReplayResult{
+		Output:   strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n"),
+		Messages: []*ReplayMessage{},
+	}
+	inputs := make(map[string]*ReplayMessage)
+	for _, line := range transcript {
+		atoms := strings.Split(line, "|")
+		if len(atoms) < 8 || atoms[0] != "filter" || atoms[FID_NAME] != "data-line" {
+			continue
+		}
+		key := atoms[FID_SID] + "|" + atoms[FID_TOKEN]
+		message, ok := inputs[key]
+		if !ok {
+			message = &ReplayMessage{Session: atoms[FID_SID], Token: atoms[FID_TOKEN], Input: []string{}, Output: []string{}}
+			result.Messages = append(result.Messages, message)
+			inputs[key] = message
+		}
+		message.Input = append(message.Input, lastAtom(line, atoms, 7))
+		if lastAtom(line, atoms, 7) == "." {
+			delete(inputs, key)
+		}
+	}
+	pending := make(map[string][]*ReplayMessage)
+	for _, message := range result.Messages {
+		key := message.Session + "|" + message.Token
+		pending[key] = append(pending[key], message)
+	}
+	for _, line := range result.Output {
+		atoms := strings.SplitN(line, "|", 4)
+		if len(atoms) < 4 || atoms[0] != "filter-dataline" {
+			continue
+		}
+		key := atoms[1] + "|" + atoms[2]
+		if len(pending[key]) == 0 {
+			slog.Warn("replay: unexpected output", "line", line)
+			continue
+		}
+		message := pending[key][0]
+		message.Output = append(message.Output, atoms[3])
+		if atoms[3] == "." {
+			pending[key] = pending[key][1:]
+		}
+	}
+	return &result
+}
+
+// diffs needing more edits than this are reported as a replacement of
+// the differing lines
+const DIFF_MAX_EDITS = 2000
+
+// DiffLines returns a line diff of a and b, with each line prefixed by ' ', '-' or '+'
+func DiffLines(a, b []string) []string {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	diff := []string{}
+	for _, line := range a[:prefix] {
+		diff = append(diff, " "+line)
+	}
+	diff = append(diff, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		diff = append(diff, " "+line)
+	}
+	return diff
+}
+
+// myersDiff returns a shortest edit script using the Myers O(ND) algorithm,
+// keeping the furthest reaching x of each diagonal k after each step d
+func myersDiff(a, b []string) []string {
+	n, m := len(a), len(b)
+	limit := min(n+m, DIFF_MAX_EDITS)
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	trace := [][]int{}
+	for d := 0; d <= limit; d++ {
+		done := false
+		for k := -d; k <= d; k += 2 {
+			x := v[offset+k-1] + 1
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			done = done || (x >= n && y >= m)
+		}
+		trace = append(trace, append([]int{}, v[offset-d:offset+d+1]...))
+		if done {
+			return myersBacktrack(a, b, trace)
+		}
+	}
+	diff := []string{}
+	for _, line := range a {
+		diff = append(diff, "-"+line)
+	}
+	for _, line := range b {
+		diff = append(diff, "+"+line)
+	}
+	return diff
+}
+
+// myersBacktrack follows the trace from the end of both inputs to the start
+func myersBacktrack(a, b []string, trace [][]int) []string {
+	diff := []string{}
+	x, y := len(a), len(b)
+	for d := len(trace) - 1; d > 0; d-- {
+		previous := trace[d-1]
+		furthest := func(k int) int { return previous[k+d-1] }
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && furthest(k-1) < furthest(k+1)) {
+			prevK = k + 1
+		}
+		prevX := furthest(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			diff = append(diff, " "+a[x-1])
+			x--
+			y--
+		}
+		if x == prevX {
+			diff = append(diff, "+"+b[y-1])
+			y--
+		} else {
+			diff = append(diff, "-"+a[x-1])
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		diff = append(diff, " "+a[x-1])
+		x--
+		y--
+	}
+	slices.Reverse(diff)
+	return diff
+}
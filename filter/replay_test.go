@@ -0,0 +1,118 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Replay", "replayed")
+	result := replayTranscript(t, f)
+	require.Len(t, result.Messages, 1)
+	message := result.Messages[0]
+	require.Equal(t, "deadbeef", message.Session)
+	require.Equal(t, "baadf00d", message.Token)
+	diff := DiffLines(message.Input, message.Output)
+	log.Println(FormatJSON(diff))
+	require.Equal(t, []string{
+		" To: touser@localdomain.ext",
+		" From: fromuser@example.org",
+		" Subject: filter test message",
+		"+X-Replay: replayed",
+		" ",
+		" first message body line",
+		" second message body line with embedded | character",
+		" third and last message body line",
+		" .",
+	}, diff)
+	require.Equal(t, "register|ready", result.Output[len(result.Output)-len(message.Output)-1])
+}
+
+// readTranscript returns the lines of the test transcript
+func readTranscript(t *testing.T) []string {
+	fp, err := os.Open(filepath.Join("testdata", "transcript.txt"))
+	require.Nil(t, err)
+	defer fp.Close()
+	transcript, err := ReadTranscript(fp)
+	require.Nil(t, err)
+	return transcript
+}
+
+// replayTranscript replays the test transcript through the filter
+func replayTranscript(t *testing.T, f *Filter) *ReplayResult {
+	return Replay(f, readTranscript(t))
+}
+
+func TestDiffLines(t *testing.T) {
+	require.Equal(t, []string{" a", "-b", "+c", " d", "+e"}, DiffLines([]string{"a", "b", "d"}, []string{"a", "c", "d", "e"}))
+	require.Equal(t, []string{}, DiffLines([]string{}, []string{}))
+	require.Equal(t, []string{"+a"}, DiffLines([]string{}, []string{"a"}))
+
+	// edit scripts rebuild both inputs with the fewest changes
+	random := rand.New(rand.NewPCG(1, 2))
+	lines := func() []string {
+		result := []string{}
+		for range random.IntN(12) {
+			result = append(result, string(rune('a'+random.IntN(4))))
+		}
+		return result
+	}
+	for range 500 {
+		a, b := lines(), lines()
+		diff := DiffLines(a, b)
+		rebuiltA, rebuiltB, edits := []string{}, []string{}, 0
+		for _, line := range diff {
+			switch line[0] {
+			case ' ':
+				rebuiltA = append(rebuiltA, line[1:])
+				rebuiltB = append(rebuiltB, line[1:])
+			case '-':
+				rebuiltA = append(rebuiltA, line[1:])
+				edits++
+			case '+':
+				rebuiltB = append(rebuiltB, line[1:])
+				edits++
+			}
+		}
+		require.Equal(t, a, rebuiltA)
+		require.Equal(t, b, rebuiltB)
+		require.Equal(t, len(a)+len(b)-2*commonLength(a, b), edits)
+	}
+
+	// large unrelated inputs fall back to replacing the differing lines
+	a, b := []string{"same"}, []string{"same"}
+	for i := range 50000 {
+		a = append(a, fmt.Sprintf("a%d", i))
+		b = append(b, fmt.Sprintf("b%d", i))
+	}
+	diff := DiffLines(a, b)
+	require.Len(t, diff, 100001)
+	require.Equal(t, " same", diff[0])
+	require.Equal(t, "-a0", diff[1])
+	require.Equal(t, "+b0", diff[50001])
+}
+
+// commonLength returns the length of the longest common subsequence
+func commonLength(a, b []string) int {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	return lcs[0][0]
+}
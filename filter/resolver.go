@@ -0,0 +1,133 @@
+package filter
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+)
+
+// Resolver looks up the DNS records used for message authentication;
+// *net.Resolver satisfies it
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// timeoutResolver bounds each lookup of the wrapped resolver
+type timeoutResolver struct {
+	resolver Resolver
+	timeout  time.Duration
+}
+
+func (r *timeoutResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.resolver.LookupTXT(ctx, name)
+}
+
+func (r *timeoutResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.resolver.LookupIPAddr(ctx, host)
+}
+
+func (r *timeoutResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.resolver.LookupMX(ctx, name)
+}
+
+func (r *timeoutResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	return r.resolver.LookupAddr(ctx, addr)
+}
+
+// lookupContext returns the resolver and context for the DNS lookups of a
+// message; each lookup is bounded by dns-timeout and the time spent in all
+// lookups of the message by auth-timeout
+func (f *Filter) lookupContext(message *Message) (Resolver, context.Context, context.CancelFunc) {
+	rules := message.Rules
+	resolver := f.Resolver
+	if rules.DNSTimeout > 0 {
+		resolver = &timeoutResolver{resolver, rules.DNSTimeout}
+	}
+	if rules.AuthTimeout <= 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		return resolver, ctx, cancel
+	}
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), max(rules.AuthTimeout-message.lookupTime, 0))
+	return resolver, ctx, func() {
+		cancel()
+		message.lookupTime += time.Since(start)
+	}
+}
+
+// MemoryResolver answers lookups from in-memory tables, for tests and offline checks
+type MemoryResolver struct {
+	TXT  map[string][]string
+	Addr map[string][]string
+	MX   map[string][]string
+	PTR  map[string][]string
+}
+
+func NewMemoryResolver() *MemoryResolver {
+	return &MemoryResolver{
+		TXT:  make(map[string][]string),
+		Addr: make(map[string][]string),
+		MX:   make(map[string][]string),
+		PTR:  make(map[string][]string),
+	}
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func memoryKey(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (r *MemoryResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	records, ok := r.TXT[memoryKey(name)]
+	if !ok {
+		return nil, notFound(name)
+	}
+	return records, nil
+}
+
+func (r *MemoryResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	records, ok := r.Addr[memoryKey(host)]
+	if !ok {
+		return nil, notFound(host)
+	}
+	addrs := []net.IPAddr{}
+	for _, record := range records {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(record)})
+	}
+	return addrs, nil
+}
+
+func (r *MemoryResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	records, ok := r.MX[memoryKey(name)]
+	if !ok {
+		return nil, notFound(name)
+	}
+	mxs := []*net.MX{}
+	for i, record := range records {
+		mxs = append(mxs, &net.MX{Host: record, Pref: uint16(10 * (i + 1))})
+	}
+	return mxs, nil
+}
+
+func (r *MemoryResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	records, ok := r.PTR[addr]
+	if !ok {
+		return nil, notFound(addr)
+	}
+	return records, nil
+}
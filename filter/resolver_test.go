@@ -0,0 +1,74 @@
+package filter
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/stretchr/testify/require"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingResolver answers no lookup before its context is done
+type blockingResolver struct{}
+
+func (r blockingResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (r blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (r blockingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (r blockingResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestLookupTimeout(t *testing.T) {
+	resolver := &timeoutResolver{blockingResolver{}, 10 * time.Millisecond}
+	result := CheckSPF(context.Background(), resolver, net.ParseIP("1.2.3.4"), "fromuser@example.org", "sendhost.example.org")
+	require.Equal(t, "temperror", result.Result)
+
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	ViperSet("dmarc", true)
+	ViperSet("authserv-id", "mx.localdomain.ext")
+	ViperSet("dns-timeout", 0)
+	ViperSet("auth-timeout", 1)
+	defer func() {
+		ViperSet("dmarc", false)
+		ViperSet("authserv-id", "")
+		ViperSet("auth-timeout", 0)
+	}()
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.Nil(t, err)
+	dkimKey, err := NewDKIMKey("example.org", "ed", edKey)
+	require.Nil(t, err)
+	message := []string{"From: fromuser@example.org", "Subject: timeout", "", "body"}
+	signature, err := DKIMSign(dkimKey, message, dkimDefaultHeaders, time.Now())
+	require.Nil(t, err)
+
+	// SPF, DKIM and DMARC lookups share the auth-timeout
+	env := Envelope{From: "fromuser@example.org", To: []string{"touser@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25", Helo: "sendhost.example.org"}
+	f := NewFilter(nil, nil)
+	f.Resolver = blockingResolver{}
+	start := time.Now()
+	simulated, err := Simulate(f, &env, append(signature, message...))
+	require.Nil(t, err)
+	require.Less(t, time.Since(start), 2*time.Second)
+	header, _ := splitMessage(simulated.Lines)
+	results := strings.Join(header, " ")
+	require.Contains(t, results, "dkim=temperror")
+	require.Contains(t, results, "spf=temperror")
+	require.Contains(t, results, "dmarc=temperror")
+}
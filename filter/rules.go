@@ -0,0 +1,682 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RuleSet is the reloadable configuration; messages keep the RuleSet
+// that was active when their transaction began.  Headers, MappedHeaders,
+// RecipientPatterns and RecipientTables form the default 'headers' rule.
+type RuleSet struct {
+	Headers           map[string]string
+	MappedHeaders     map[string]*MappedHeader
+	RecipientPatterns []*regexp.Regexp
+	RecipientTables   []*Table
+	NamedRules        []*HeaderRule
+	FooterText        string
+	FooterHTML        string
+	BannerText        string
+	BannerHTML        string
+	InternalNetworks  []*net.IPNet
+	DryRun            map[string]bool
+	TraceHeader       string
+	TracePatterns     []*regexp.Regexp
+	SignKey           []byte
+	SignHeaders       []string
+	SignatureHeader   string
+	SignatureMaxAge   time.Duration
+	VerifySignature   bool
+	VerifyKey         []byte
+	VerifyAction      string
+	StripInbound      bool
+	StripAction       string
+	DKIMKeys          map[string]*DKIMKey
+	DKIMHeaders       []string
+	DKIMVerify        bool
+	AuthServId        string
+	DNSTimeout        time.Duration
+	AuthTimeout       time.Duration
+	SPF               bool
+	DMARC             bool
+	ARCKey            *DKIMKey
+}
+
+// names of the rules configured by top level options
+var builtinRules = []string{"headers", "footer", "banner", "trace", "sign", "verify", "strip", "dkim", "dkim-verify", "spf", "arc"}
+
+// HeaderRule adds its headers to messages with a recipient matching one of
+// its patterns or tables, or to all messages if it has neither.  A rule
+// with SPF or DMARC results only matches messages with one of those results.
+// MappedHeaders take their values from a map or table lookup.
+type HeaderRule struct {
+	Name              string
+	Headers           map[string]string
+	MappedHeaders     map[string]*MappedHeader
+	RecipientPatterns []*regexp.Regexp
+	RecipientTables   []*Table
+	SPF               []string
+	DMARC             []string
+	SubjectPrefix     string
+	DryRun            bool
+}
+
+func NewHeaderRule(name string) *HeaderRule {
+	return &HeaderRule{
+		Name:              name,
+		Headers:           make(map[string]string),
+		MappedHeaders:     make(map[string]*MappedHeader),
+		RecipientPatterns: []*regexp.Regexp{},
+		RecipientTables:   []*Table{},
+	}
+}
+
+// ConfigError identifies the config key and value that failed validation
+type ConfigError struct {
+	Key   string
+	Value string
+	Err   error
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s '%s': %v", e.Key, e.Value, e.Err)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+func ParseHeader(header string) (string, string, error) {
+	key, value, ok := strings.Cut(header, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid header config: %s", header)
+	}
+	return key, value, nil
+}
+
+// ValidateHeaderName checks for an RFC 5322 field name
+func ValidateHeaderName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty header name")
+	}
+	for _, c := range name {
+		if c < 33 || c > 126 || c == ':' {
+			return fmt.Errorf("invalid character %q in header name", c)
+		}
+	}
+	return nil
+}
+
+// HeaderRules returns the default rule, if it has headers, followed by the named rules
+func (r *RuleSet) HeaderRules() []*HeaderRule {
+	rules := []*HeaderRule{}
+	if len(r.Headers) > 0 || len(r.MappedHeaders) > 0 {
+		rules = append(rules, r.defaultRule())
+	}
+	return append(rules, r.NamedRules...)
+}
+
+func (r *RuleSet) defaultRule() *HeaderRule {
+	return &HeaderRule{
+		Name:              "headers",
+		Headers:           r.Headers,
+		MappedHeaders:     r.MappedHeaders,
+		RecipientPatterns: r.RecipientPatterns,
+		RecipientTables:   r.RecipientTables,
+		DryRun:            r.IsDryRun("headers"),
+	}
+}
+
+// IsDryRun returns true if the named rule is evaluated and logged without modifying messages
+func (r *RuleSet) IsDryRun(rule string) bool {
+	return r.DryRun[rule]
+}
+
+// HeaderKeys returns the default rule's header names in sorted order
+func (r *RuleSet) HeaderKeys() []string {
+	return r.defaultRule().HeaderKeys()
+}
+
+func (r *RuleSet) addHeader(key, value string) error {
+	rule := r.defaultRule()
+	return rule.addHeader(key, value)
+}
+
+// HeaderKeys returns the rule's header names in sorted order
+func (r *HeaderRule) HeaderKeys() []string {
+	keys := []string{}
+	for key := range r.Headers {
+		keys = append(keys, key)
+	}
+	for key := range r.MappedHeaders {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// HeaderValues returns the values of a rule header for the message; a
+// mapped header may have no value or several
+func (r *HeaderRule) HeaderValues(key string, session *Session, message *Message) []string {
+	mapped, ok := r.MappedHeaders[key]
+	if !ok {
+		return []string{r.Headers[key]}
+	}
+	return mapped.Values(session, message)
+}
+
+func (r *HeaderRule) addHeader(key, value string) error {
+	err := ValidateHeaderName(key)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("header value contains line break")
+	}
+	r.Headers[key] = value
+	return nil
+}
+
+// LoadRules returns a RuleSet built from the filter's static settings and the current config
+func (f *Filter) LoadRules() (*RuleSet, error) {
+	rules, errs := f.buildRules()
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return rules, nil
+}
+
+// CheckRules returns every validation error in the filter settings and current config
+func (f *Filter) CheckRules() []error {
+	_, errs := f.buildRules()
+	return errs
+}
+
+func (f *Filter) buildRules() (*RuleSet, []error) {
+	errs := []error{}
+	rules := RuleSet{
+		Headers:           make(map[string]string),
+		MappedHeaders:     make(map[string]*MappedHeader),
+		RecipientPatterns: append([]*regexp.Regexp{}, f.RecipientPatterns...),
+		FooterText:        f.FooterText,
+		FooterHTML:        f.FooterHTML,
+		BannerText:        f.BannerText,
+		BannerHTML:        f.BannerHTML,
+		InternalNetworks:  append([]*net.IPNet{}, f.InternalNetworks...),
+		NamedRules:        []*HeaderRule{},
+		DryRun:            make(map[string]bool),
+	}
+	for key, value := range f.Headers {
+		err := rules.addHeader(key, value)
+		if err != nil {
+			errs = append(errs, &ConfigError{"header", key + "=" + value, err})
+		}
+	}
+	for _, header := range ViperGetStringSlice("header") {
+		key, value, err := ParseHeader(header)
+		if err == nil {
+			err = rules.addHeader(key, value)
+		}
+		if err != nil {
+			errs = append(errs, &ConfigError{"header", header, err})
+		}
+	}
+	for _, pattern := range ViperGetStringSlice("recipient") {
+		p, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, &ConfigError{"recipient", pattern, err})
+			continue
+		}
+		rules.RecipientPatterns = append(rules.RecipientPatterns, p)
+	}
+	tables, tableErrs := buildTables("recipient-table", ViperGetStringSlice("recipient-table"))
+	rules.RecipientTables = tables
+	errs = append(errs, tableErrs...)
+	errs = append(errs, buildHeaderTables("header-table", ViperGetStringSlice("header-table"), rules.Headers, rules.MappedHeaders)...)
+	errs = append(errs, buildMappedHeaders("mapped-header", ViperGet("mapped-header"), rules.Headers, rules.MappedHeaders)...)
+	if footer := ViperGetString("footer-text"); footer != "" {
+		rules.FooterText = footer
+	}
+	if footer := ViperGetString("footer-html"); footer != "" {
+		rules.FooterHTML = footer
+	}
+	if banner := ViperGetString("banner-text"); banner != "" {
+		rules.BannerText = banner
+	}
+	if banner := ViperGetString("banner-html"); banner != "" {
+		rules.BannerHTML = banner
+	}
+	for _, cidr := range ViperGetStringSlice("internal-net") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			errs = append(errs, &ConfigError{"internal-net", cidr, err})
+			continue
+		}
+		rules.InternalNetworks = append(rules.InternalNetworks, network)
+	}
+	rules.TracePatterns = []*regexp.Regexp{}
+	for _, pattern := range ViperGetStringSlice("trace-recipient") {
+		p, err := regexp.Compile(pattern)
+		if err != nil {
+			errs = append(errs, &ConfigError{"trace-recipient", pattern, err})
+			continue
+		}
+		rules.TracePatterns = append(rules.TracePatterns, p)
+	}
+	if ViperGetBool("trace") || len(rules.TracePatterns) > 0 {
+		rules.TraceHeader = ViperGetString("trace-header")
+		if rules.TraceHeader == "" {
+			rules.TraceHeader = "X-Addheader-Trace"
+		}
+		err := ValidateHeaderName(rules.TraceHeader)
+		if err != nil {
+			errs = append(errs, &ConfigError{"trace-header", rules.TraceHeader, err})
+		}
+	}
+	errs = append(errs, rules.buildSignature()...)
+	errs = append(errs, rules.buildStrip()...)
+	errs = append(errs, rules.buildDKIM()...)
+	errs = append(errs, rules.buildSPF()...)
+	errs = append(errs, rules.buildDMARC()...)
+	errs = append(errs, rules.buildARC()...)
+	errs = append(errs, rules.buildAuthentication()...)
+	ruleConfig, storeErrs := f.ruleConfig()
+	errs = append(errs, storeErrs...)
+	errs = append(errs, rules.buildNamedRules(ruleConfig)...)
+	dryRun := ViperGetBool("dry-run")
+	names := append([]string{}, builtinRules...)
+	for _, rule := range rules.NamedRules {
+		names = append(names, rule.Name)
+	}
+	for _, name := range names {
+		rules.DryRun[name] = dryRun
+	}
+	for _, name := range ViperGetStringSlice("dry-run-rule") {
+		_, ok := rules.DryRun[name]
+		if !ok {
+			errs = append(errs, &ConfigError{"dry-run-rule", name, fmt.Errorf("unknown rule")})
+			continue
+		}
+		rules.DryRun[name] = true
+	}
+	for _, rule := range rules.NamedRules {
+		rule.DryRun = rule.DryRun || rules.DryRun[rule.Name]
+		rules.DryRun[rule.Name] = rule.DryRun
+	}
+	return &rules, errs
+}
+
+// buildNamedRules parses the rules config list; each entry has a name, a
+// list of KEY=VALUE headers, KEY=TABLE table headers and mapped headers, optional
+// recipient patterns and tables, SPF and DMARC results, which require the
+// spf and dmarc options, a subject_prefix and a dry_run flag
+func (r *RuleSet) buildNamedRules(config any) []error {
+	r.NamedRules = []*HeaderRule{}
+	errs := []error{}
+	if config == nil {
+		return errs
+	}
+	entries, ok := config.([]any)
+	if !ok {
+		return []error{&ConfigError{"rules", fmt.Sprintf("%v", config), fmt.Errorf("expected a list of rules")}}
+	}
+	names := make(map[string]bool)
+	for _, name := range builtinRules {
+		names[name] = true
+	}
+	for i, entry := range entries {
+		fields, ok := entry.(map[string]any)
+		if !ok {
+			errs = append(errs, &ConfigError{"rules", fmt.Sprintf("%v", entry), fmt.Errorf("expected a rule mapping")})
+			continue
+		}
+		name, _ := fields["name"].(string)
+		if name == "" {
+			name = fmt.Sprintf("rule%d", i+1)
+		}
+		if names[name] {
+			errs = append(errs, &ConfigError{"rules", name, fmt.Errorf("duplicate rule name")})
+			continue
+		}
+		names[name] = true
+		rule := NewHeaderRule(name)
+		for _, header := range configStrings(fields["header"]) {
+			key, value, err := ParseHeader(header)
+			if err == nil {
+				err = rule.addHeader(key, value)
+			}
+			if err != nil {
+				errs = append(errs, &ConfigError{"rules." + name + ".header", header, err})
+			}
+		}
+		errs = append(errs, buildHeaderTables("rules."+name+".header_table", configStrings(fields["header_table"]), rule.Headers, rule.MappedHeaders)...)
+		errs = append(errs, buildMappedHeaders("rules."+name+".mapped_header", fields["mapped_header"], rule.Headers, rule.MappedHeaders)...)
+		if prefix, ok := fields["subject_prefix"]; ok {
+			rule.SubjectPrefix = strings.TrimSpace(fmt.Sprintf("%v", prefix))
+			if strings.ContainsAny(rule.SubjectPrefix, "\r\n") {
+				errs = append(errs, &ConfigError{"rules." + name + ".subject_prefix", rule.SubjectPrefix, fmt.Errorf("subject prefix contains line break")})
+			}
+		}
+		if len(rule.Headers) == 0 && len(rule.MappedHeaders) == 0 && rule.SubjectPrefix == "" {
+			errs = append(errs, &ConfigError{"rules", name, fmt.Errorf("rule has no headers or subject prefix")})
+		}
+		for _, pattern := range configStrings(fields["recipient"]) {
+			p, err := regexp.Compile(pattern)
+			if err != nil {
+				errs = append(errs, &ConfigError{"rules." + name + ".recipient", pattern, err})
+				continue
+			}
+			rule.RecipientPatterns = append(rule.RecipientPatterns, p)
+		}
+		tables, tableErrs := buildTables("rules."+name+".recipient_table", configStrings(fields["recipient_table"]))
+		rule.RecipientTables = tables
+		errs = append(errs, tableErrs...)
+		for _, result := range configStrings(fields["spf"]) {
+			if !slices.Contains(spfResults, result) {
+				errs = append(errs, &ConfigError{"rules." + name + ".spf", result, fmt.Errorf("unknown SPF result")})
+				continue
+			}
+			rule.SPF = append(rule.SPF, result)
+		}
+		for _, result := range configStrings(fields["dmarc"]) {
+			if !slices.Contains(dmarcResults, result) {
+				errs = append(errs, &ConfigError{"rules." + name + ".dmarc", result, fmt.Errorf("unknown DMARC result")})
+				continue
+			}
+			rule.DMARC = append(rule.DMARC, result)
+		}
+		if len(rule.SPF) > 0 && !r.SPF {
+			errs = append(errs, &ConfigError{"rules." + name + ".spf", strings.Join(rule.SPF, ","), fmt.Errorf("SPF condition requires the spf option")})
+		}
+		if len(rule.DMARC) > 0 && !r.DMARC {
+			errs = append(errs, &ConfigError{"rules." + name + ".dmarc", strings.Join(rule.DMARC, ","), fmt.Errorf("DMARC condition requires the dmarc option")})
+		}
+		for _, key := range []string{"dry_run", "dry-run"} {
+			if value, ok := fields[key].(bool); ok {
+				rule.DryRun = value
+			}
+		}
+		r.NamedRules = append(r.NamedRules, rule)
+	}
+	return errs
+}
+
+// configStrings returns a config value that may be a single string or a list
+func configStrings(value any) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := []string{}
+		for _, item := range v {
+			values = append(values, fmt.Sprintf("%v", item))
+		}
+		return values
+	case []string:
+		return v
+	}
+	return []string{}
+}
+
+// Rules returns the active RuleSet
+func (f *Filter) Rules() *RuleSet {
+	return f.rules.Load()
+}
+
+// Reload re-reads the config file and replaces the active RuleSet; on
+// failure the current RuleSet and config remain active
+func (f *Filter) Reload() error {
+	f.reloadLock.Lock()
+	defer f.reloadLock.Unlock()
+	// keep the current config to restore if the new rules are rejected,
+	// so a later database refresh does not load the rejected config
+	var current *bytes.Buffer
+	if viper.ConfigFileUsed() != "" {
+		current = &bytes.Buffer{}
+		err := viper.WriteConfigTo(current)
+		if err != nil {
+			return fmt.Errorf("failed saving config: %v", err)
+		}
+		err = viper.ReadInConfig()
+		if err != nil {
+			return fmt.Errorf("failed reading config: %v", err)
+		}
+	}
+	err := f.swapRules()
+	if err != nil {
+		if current != nil {
+			restoreErr := viper.ReadConfig(current)
+			if restoreErr != nil {
+				f.log.Error("failed restoring config", "error", restoreErr)
+			}
+		}
+		return err
+	}
+	f.reloadStore()
+	return nil
+}
+
+// reloadStore retries rejected database rules with the new config and
+// applies a changed rules-db-refresh interval
+func (f *Filter) reloadStore() {
+	f.storeLock.Lock()
+	store := f.store
+	f.storeLock.Unlock()
+	if store != nil {
+		store.Reject(nil)
+	}
+	f.watchStore()
+}
+
+func (f *Filter) swapRules() error {
+	rules, err := f.LoadRules()
+	if err != nil {
+		return err
+	}
+	f.rules.Store(rules)
+	f.log.Info("rules loaded", "headers", len(rules.Headers), "recipient_patterns", len(rules.RecipientPatterns), "named_rules", len(rules.NamedRules))
+	f.logRules(rules)
+	return nil
+}
+
+func (f *Filter) logRules(rules *RuleSet) {
+	for _, rule := range rules.HeaderRules() {
+		for key, value := range rule.Headers {
+			f.log.Debug("rule", "rule", rule.Name, "header", key, "value", value, "dry_run", rule.DryRun)
+		}
+		for key, mapped := range rule.MappedHeaders {
+			f.log.Debug("rule", "rule", rule.Name, "header", key, "mapped_key", mapped.Key, "mode", mapped.Mode, "dry_run", rule.DryRun)
+		}
+		for _, pattern := range rule.RecipientPatterns {
+			f.log.Debug("rule", "rule", rule.Name, "recipient_pattern", pattern.String())
+		}
+		for _, table := range rule.RecipientTables {
+			f.log.Debug("rule", "rule", rule.Name, "recipient_table", table.Spec)
+		}
+	}
+	if rules.FooterText != "" {
+		f.log.Debug("rule", "rule", "footer", "text", rules.FooterText)
+	}
+	if rules.FooterHTML != "" {
+		f.log.Debug("rule", "rule", "footer", "html", rules.FooterHTML)
+	}
+	if rules.BannerText != "" {
+		f.log.Debug("rule", "rule", "banner", "text", rules.BannerText)
+	}
+	if rules.BannerHTML != "" {
+		f.log.Debug("rule", "rule", "banner", "html", rules.BannerHTML)
+	}
+	for _, network := range rules.InternalNetworks {
+		f.log.Debug("rule", "rule", "banner", "internal_network", network.String())
+	}
+}
+
+// reload on SIGHUP, and on config file change if enabled
+func (f *Filter) watchConfig() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			f.log.Info("SIGHUP received; reloading config")
+			err := f.Reload()
+			if err != nil {
+				f.log.Error("reload failed; keeping current rules", "error", err)
+			}
+		}
+	}()
+	if ViperGetBool("watch-config") && viper.ConfigFileUsed() != "" {
+		err := f.watchConfigFile(viper.ConfigFileUsed())
+		if err != nil {
+			f.log.Error("config file watch failed", "file", viper.ConfigFileUsed(), "error", err)
+		}
+	}
+}
+
+// watchConfigFile reloads when the config file changes; the directory is
+// watched so files replaced by editors are seen, and reloads go through
+// Reload so viper is only read under the reload lock
+func (f *Filter) watchConfigFile(configFile string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	configFile = filepath.Clean(configFile)
+	err = watcher.Add(filepath.Dir(configFile))
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != configFile || !(event.Has(fsnotify.Write) || event.Has(fsnotify.Create)) {
+					continue
+				}
+				f.log.Info("config file changed; reloading config", "file", event.Name)
+				err := f.Reload()
+				if err != nil {
+					f.log.Error("reload failed; keeping current rules", "error", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				f.log.Warn("config file watch error", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// MarshalJSON formats the rules with patterns and networks as strings
+func (r *RuleSet) MarshalJSON() ([]byte, error) {
+	patterns := []string{}
+	for _, pattern := range r.RecipientPatterns {
+		patterns = append(patterns, pattern.String())
+	}
+	networks := []string{}
+	for _, network := range r.InternalNetworks {
+		networks = append(networks, network.String())
+	}
+	return json.Marshal(struct {
+		Headers           map[string]string
+		MappedHeaders     map[string]*MappedHeader
+		RecipientPatterns []string
+		RecipientTables   []string
+		NamedRules        []*HeaderRule
+		FooterText        string
+		FooterHTML        string
+		BannerText        string
+		BannerHTML        string
+		InternalNetworks  []string
+		DryRun            map[string]bool
+	}{r.Headers, r.MappedHeaders, patterns, tableList(r.RecipientTables), r.NamedRules, r.FooterText, r.FooterHTML, r.BannerText, r.BannerHTML, networks, r.DryRun})
+}
+
+// conditionsMatch checks the message authentication results required by
+// the rule, returning a detail string for the trace header
+func (r *HeaderRule) conditionsMatch(message *Message) (bool, string) {
+	match := true
+	details := []string{}
+	if len(r.SPF) > 0 {
+		result := "none"
+		if message.SPF != nil {
+			result = message.SPF.Result
+		}
+		match = match && slices.Contains(r.SPF, result)
+		details = append(details, "spf="+result)
+	}
+	if len(r.DMARC) > 0 {
+		result := "none"
+		if message.DMARC != nil {
+			result = message.DMARC.Result
+		}
+		match = match && slices.Contains(r.DMARC, result)
+		details = append(details, "dmarc="+result)
+	}
+	return match, strings.Join(details, " ")
+}
+
+// MarshalJSON formats the rule with patterns as strings
+func (r *HeaderRule) MarshalJSON() ([]byte, error) {
+	patterns := []string{}
+	for _, pattern := range r.RecipientPatterns {
+		patterns = append(patterns, pattern.String())
+	}
+	return json.Marshal(struct {
+		Name              string
+		Headers           map[string]string
+		MappedHeaders     map[string]*MappedHeader
+		RecipientPatterns []string
+		RecipientTables   []string
+		SPF               []string
+		DMARC             []string
+		SubjectPrefix     string `json:",omitempty"`
+		DryRun            bool
+	}{r.Name, r.Headers, r.MappedHeaders, patterns, tableList(r.RecipientTables), r.SPF, r.DMARC, r.SubjectPrefix, r.DryRun})
+}
+
+// sessions are internal if authenticated or connected from an internal network
+func (r *RuleSet) IsExternal(session *Session) bool {
+	if session.AuthorizedUser != "" {
+		return false
+	}
+	if strings.HasPrefix(session.Remote, "unix:") {
+		return false
+	}
+	host, _, err := net.SplitHostPort(session.Remote)
+	if err != nil {
+		host = strings.Trim(session.Remote, "[]")
+	}
+	addr := net.ParseIP(host)
+	if addr == nil {
+		slog.Warn("unparsable remote address", "session", session.Id, "remote", session.Remote)
+		return true
+	}
+	for _, network := range r.InternalNetworks {
+		if network.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,200 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig := func(config string) {
+		err := os.WriteFile(configFile, []byte(config), 0600)
+		require.Nil(t, err)
+	}
+	writeConfig("smtpd_filter_addheader:\n  header:\n    - X-Test=one\n")
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Static", "static")
+	require.Nil(t, f.Reload())
+	require.Equal(t, map[string]string{"X-Static": "static", "X-Test": "one"}, f.Rules().Headers)
+
+	f.Sessions["deadbeef"] = NewSession("deadbeef", "", true, "1.2.3.4:11223", "")
+	f.txBegin("tx-begin", "deadbeef", "cafebabe")
+
+	writeConfig("smtpd_filter_addheader:\n  header:\n    - X-Test=two\n")
+	require.Nil(t, f.Reload())
+	require.Equal(t, "two", f.Rules().Headers["X-Test"])
+	require.Equal(t, "one", f.Sessions["deadbeef"].Messages["cafebabe"].Rules.Headers["X-Test"])
+
+	writeConfig("smtpd_filter_addheader:\n  recipient:\n    - '(unclosed'\n")
+	require.NotNil(t, f.Reload())
+	require.Equal(t, "two", f.Rules().Headers["X-Test"])
+
+	writeConfig("smtpd_filter_addheader:\n  header: [\n")
+	require.NotNil(t, f.Reload())
+	require.Equal(t, "two", f.Rules().Headers["X-Test"])
+}
+
+func TestWatchConfigFile(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	require.Nil(t, os.WriteFile(configFile, []byte("smtpd_filter_addheader:\n  header:\n    - X-Test=one\n"), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+
+	f := NewFilter(nil, nil)
+	require.Nil(t, f.Reload())
+	require.Nil(t, f.watchConfigFile(configFile))
+	require.Nil(t, os.WriteFile(configFile, []byte("smtpd_filter_addheader:\n  header:\n    - X-Test=two\n"), 0600))
+	require.Eventually(t, func() bool {
+		return f.Rules().Headers["X-Test"] == "two"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCheckRules(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := `smtpd_filter_addheader:
+  header:
+    - X-Good=ok
+    - Bad Name=value
+    - X-From=sender {{.Message.From}}
+  recipient:
+    - '(unclosed'
+  internal_net:
+    - 10.0.0.0/33
+`
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+
+	f := NewFilter(nil, nil)
+	require.NotNil(t, f.AddRecipientPattern("(unclosed"))
+	require.Empty(t, f.RecipientPatterns)
+	errs := f.CheckRules()
+	require.Len(t, errs, 3)
+	keys := []string{}
+	for _, err := range errs {
+		keys = append(keys, err.(*ConfigError).Key)
+	}
+	require.Equal(t, []string{"header", "recipient", "internal-net"}, keys)
+	_, err := f.LoadRules()
+	require.NotNil(t, err)
+}
+
+func TestDryRun(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := `smtpd_filter_addheader:
+  header:
+    - X-Default=default
+  footer_text: "-- footer"
+  dry_run_rule:
+    - footer
+  rules:
+    - name: tenant
+      header:
+        - X-Tenant=tenant
+      recipient:
+        - '@localdomain\.ext$'
+    - name: canary
+      header:
+        - X-Canary=canary
+      dry_run: true
+    - name: other
+      header:
+        - X-Other=other
+      recipient:
+        - '@elsewhere\.ext$'
+`
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+
+	message, err := ReadMessage(strings.NewReader("To: touser@localdomain.ext\nSubject: dry run\n\nbody\n"))
+	require.Nil(t, err)
+	env := Envelope{From: "fromuser@example.org", To: []string{"touser@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+	f := NewFilter(nil, nil)
+	result, err := Simulate(f, &env, message)
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"To: touser@localdomain.ext",
+		"Subject: dry run",
+		"X-Default: default",
+		"X-Tenant: tenant",
+		"",
+		"body",
+	}, result.Lines)
+	require.Equal(t, []Action{
+		{"headers", "add-header", "X-Default: default"},
+		{"tenant", "add-header", "X-Tenant: tenant"},
+		{"canary", "dry-run add-header", "X-Canary: canary"},
+		{"footer", "dry-run add-footer", "text/plain"},
+	}, result.Actions)
+	require.Equal(t, uint64(1), f.Metrics.DryRuns[metricsDryRun{"canary", "add-header"}])
+	require.Equal(t, uint64(1), f.Metrics.DryRuns[metricsDryRun{"footer", "add-footer"}])
+
+	ViperSet("dry-run", true)
+	defer ViperSet("dry-run", false)
+	f = NewFilter(nil, nil)
+	result, err = Simulate(f, &env, message)
+	require.Nil(t, err)
+	require.Equal(t, message, result.Lines)
+	for _, action := range result.Actions {
+		require.True(t, strings.HasPrefix(action.Action, "dry-run "), action.Action)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := `smtpd_filter_addheader:
+  header:
+    - X-Default=default
+  banner_text: "EXTERNAL"
+  trace_recipient:
+    - '^support@'
+  rules:
+    - name: tenant
+      header:
+        - X-Tenant=tenant
+      recipient:
+        - '@elsewhere\.ext$'
+`
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+
+	message, err := ReadMessage(strings.NewReader("Subject: trace\n\nbody\n"))
+	require.Nil(t, err)
+	env := Envelope{From: "fromuser@example.org", To: []string{"support@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+	result, err := Simulate(NewFilter(nil, nil), &env, message)
+	require.Nil(t, err)
+	require.Equal(t, []string{
+		"Subject: trace",
+		"X-Default: default",
+		"X-Addheader-Trace: version=" + Version + "; headers=all; tenant=no-match;",
+		"\tbanner=external",
+		"",
+		"EXTERNAL",
+		"body",
+	}, result.Lines)
+
+	// the trace header does not reveal other recipients or rule patterns
+	env.To = []string{"support@localdomain.ext", "bcc@elsewhere.ext"}
+	result, err = Simulate(NewFilter(nil, nil), &env, message)
+	require.Nil(t, err)
+	require.Contains(t, result.Lines, "X-Addheader-Trace: version="+Version+"; headers=all; tenant=match; banner=external")
+	for _, line := range result.Lines {
+		require.NotContains(t, line, "elsewhere")
+	}
+
+	env.To = []string{"touser@localdomain.ext"}
+	result, err = Simulate(NewFilter(nil, nil), &env, message)
+	require.Nil(t, err)
+	for _, line := range result.Lines {
+		require.False(t, strings.HasPrefix(line, "X-Addheader-Trace:"))
+	}
+}
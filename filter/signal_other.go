@@ -0,0 +1,9 @@
+//go:build windows || plan9
+
+package filter
+
+import (
+	"os"
+)
+
+var stateSignals = []os.Signal{}
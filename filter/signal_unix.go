@@ -0,0 +1,10 @@
+//go:build !windows && !plan9
+
+package filter
+
+import (
+	"os"
+	"syscall"
+)
+
+var stateSignals = []os.Signal{syscall.SIGUSR1}
@@ -0,0 +1,336 @@
+package filter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SIGNATURE_HEADER = "X-Addheader-Signature"
+
+// signatures dated later than this are invalid
+const SIGNATURE_CLOCK_SKEW = 5 * time.Minute
+
+// buildSignature reads the tag header signing and verification options
+func (r *RuleSet) buildSignature() []error {
+	errs := []error{}
+	r.SignHeaders = []string{}
+	for _, name := range ViperGetStringSlice("sign-header") {
+		err := ValidateHeaderName(name)
+		if err != nil {
+			errs = append(errs, &ConfigError{"sign-header", name, err})
+			continue
+		}
+		r.SignHeaders = append(r.SignHeaders, name)
+	}
+	r.SignatureHeader = ViperGetString("signature-header")
+	if r.SignatureHeader == "" {
+		r.SignatureHeader = SIGNATURE_HEADER
+	}
+	err := ValidateHeaderName(r.SignatureHeader)
+	if err != nil {
+		errs = append(errs, &ConfigError{"signature-header", r.SignatureHeader, err})
+	}
+	r.VerifySignature = ViperGetBool("verify-signature")
+	maxAge := ViperGetInt("max-age")
+	if maxAge < 0 {
+		errs = append(errs, &ConfigError{"max-age", strconv.Itoa(maxAge), fmt.Errorf("expected seconds or 0 for no limit")})
+	}
+	r.SignatureMaxAge = time.Duration(maxAge) * time.Second
+	r.VerifyAction = ViperGetString("verify-action")
+	switch r.VerifyAction {
+	case "":
+		r.VerifyAction = "flag"
+	case "flag", "strip":
+	default:
+		errs = append(errs, &ConfigError{"verify-action", r.VerifyAction, fmt.Errorf("expected flag or strip")})
+	}
+	keyFile := ViperGetString("sign-key-file")
+	if keyFile == "" {
+		if len(r.SignHeaders) > 0 || r.VerifySignature {
+			errs = append(errs, &ConfigError{"sign-key-file", keyFile, fmt.Errorf("required to sign or verify headers")})
+		}
+		return errs
+	}
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return append(errs, &ConfigError{"sign-key-file", keyFile, err})
+	}
+	key = []byte(strings.TrimSpace(string(key)))
+	if len(key) == 0 {
+		return append(errs, &ConfigError{"sign-key-file", keyFile, fmt.Errorf("empty key")})
+	}
+	if len(r.SignHeaders) == 0 {
+		return append(errs, &ConfigError{"sign-header", "", fmt.Errorf("required to sign or verify headers")})
+	}
+	if !r.VerifySignature {
+		r.SignKey = key
+	} else {
+		r.VerifyKey = key
+	}
+	return errs
+}
+
+// headerFields groups header lines into fields with their continuation lines
+func headerFields(lines []string) [][]string {
+	fields := [][]string{}
+	for _, line := range lines {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] = append(fields[len(fields)-1], line)
+			continue
+		}
+		fields = append(fields, []string{line})
+	}
+	return fields
+}
+
+// fieldName returns the header field name, or "" if the field has none
+func fieldName(field []string) string {
+	name, _, ok := strings.Cut(field[0], ":")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSpace(name)
+}
+
+// fieldValue returns the unfolded header field value
+func fieldValue(field []string) string {
+	_, value, _ := strings.Cut(strings.Join(field, ""), ":")
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// headerValues returns the values of each occurrence of the named field
+func headerValues(lines []string, name string) []string {
+	values := []string{}
+	for _, field := range headerFields(lines) {
+		if strings.EqualFold(fieldName(field), name) {
+			values = append(values, fieldValue(field))
+		}
+	}
+	return values
+}
+
+// removeFields returns the header lines without the named fields
+func removeFields(lines []string, names ...string) ([]string, []string) {
+	kept := []string{}
+	removed := []string{}
+	for _, field := range headerFields(lines) {
+		match := false
+		for _, name := range names {
+			if strings.EqualFold(fieldName(field), name) {
+				match = true
+				break
+			}
+		}
+		if match {
+			removed = append(removed, fieldName(field)+": "+fieldValue(field))
+		} else {
+			kept = append(kept, field...)
+		}
+	}
+	return kept, removed
+}
+
+// removeHeaderFields removes the named fields from the header for the
+// rule, recording each removal; in dry-run mode the header is unchanged
+func (f *Filter) removeHeaderFields(log *slog.Logger, message *Message, record *AuditRecord, rule string, header []string, names ...string) []string {
+	kept, removed := removeFields(header, names...)
+	if len(removed) == 0 {
+		return header
+	}
+	dryRun := message.Rules.IsDryRun(rule)
+	for _, line := range removed {
+		if dryRun {
+			log.Info("dry-run: header not removed", "rule", rule, "action", "remove-header", "header", line, "dry_run", true)
+			message.Actions = append(message.Actions, Action{rule, "dry-run remove-header", line})
+			f.Metrics.dryRun(rule, "remove-header")
+			continue
+		}
+		log.Info("header removed", "rule", rule, "action", "remove-header", "header", line)
+		message.Actions = append(message.Actions, Action{rule, "remove-header", line})
+		record.Removed = append(record.Removed, line)
+	}
+	if dryRun {
+		return header
+	}
+	if !slices.Contains(record.Rules, rule) {
+		record.Rules = append(record.Rules, rule)
+	}
+	return kept
+}
+
+// computeSignature returns the HMAC-SHA256 of the timestamp, the Message-ID
+// and every occurrence of the named header fields
+func computeSignature(key []byte, timestamp int64, header []string, names []string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "v=1\nt=%d\n", timestamp)
+	fmt.Fprintf(mac, "message-id:%s\n", strings.Join(headerValues(header, "Message-ID"), ","))
+	for _, name := range names {
+		for _, value := range headerValues(header, name) {
+			fmt.Fprintf(mac, "%s:%s\n", strings.ToLower(name), value)
+		}
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type tagSignature struct {
+	Timestamp int64
+	Names     []string
+	Signature string
+}
+
+func (s *tagSignature) String() string {
+	return fmt.Sprintf("v=1; t=%d; h=%s; s=%s", s.Timestamp, strings.Join(s.Names, ":"), s.Signature)
+}
+
+func parseTagSignature(value string) (*tagSignature, error) {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(strings.TrimSpace(tag), "=")
+		if ok {
+			tags[strings.TrimSpace(key)] = strings.TrimSpace(val)
+		}
+	}
+	if tags["v"] != "1" {
+		return nil, fmt.Errorf("unsupported version")
+	}
+	timestamp, err := strconv.ParseInt(tags["t"], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp")
+	}
+	if tags["h"] == "" || tags["s"] == "" {
+		return nil, fmt.Errorf("missing tag")
+	}
+	return &tagSignature{Timestamp: timestamp, Names: strings.Split(tags["h"], ":"), Signature: tags["s"]}, nil
+}
+
+// stripSigned removes received copies of the signed headers and the
+// signature header, so only the values this filter adds are signed
+func (f *Filter) stripSigned(log *slog.Logger, message *Message, header []string, record *AuditRecord) []string {
+	rules := message.Rules
+	return f.removeHeaderFields(log, message, record, "sign", header, append([]string{rules.SignatureHeader}, rules.SignHeaders...)...)
+}
+
+// signHeaders returns the signature header for the configured headers present in header
+func (f *Filter) signHeaders(log *slog.Logger, message *Message, header []string, record *AuditRecord) []string {
+	rules := message.Rules
+	names := []string{}
+	for _, name := range rules.SignHeaders {
+		if len(headerValues(header, name)) > 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return []string{}
+	}
+	signature := tagSignature{Timestamp: time.Now().Unix(), Names: names}
+	signature.Signature = computeSignature(rules.SignKey, signature.Timestamp, header, names)
+	value := signature.String()
+	line := rules.SignatureHeader + ": " + value
+	if rules.IsDryRun("sign") {
+		log.Info("dry-run: header not added", "rule", "sign", "action", "add-header", "header", rules.SignatureHeader, "value", value, "dry_run", true)
+		message.Actions = append(message.Actions, Action{"sign", "dry-run add-header", line})
+		f.Metrics.dryRun("sign", "add-header")
+		return []string{}
+	}
+	log.Info("header added", "rule", "sign", "action", "add-header", "header", rules.SignatureHeader, "value", value)
+	message.Actions = append(message.Actions, Action{"sign", "add-header", line})
+	f.Metrics.headerAdded("sign", rules.SignatureHeader)
+	record.Added = append(record.Added, line)
+	record.Rules = append(record.Rules, "sign")
+	return []string{line}
+}
+
+// VerifyTagSignature checks the signature of the configured headers, returning "pass",
+// "none" if no signed headers are present, or "fail" with the reason
+func VerifyTagSignature(rules *RuleSet, header []string, now time.Time) (string, string) {
+	present := []string{}
+	for _, name := range rules.SignHeaders {
+		if len(headerValues(header, name)) > 0 {
+			present = append(present, name)
+		}
+	}
+	values := headerValues(header, rules.SignatureHeader)
+	if len(values) == 0 {
+		if len(present) == 0 {
+			return "none", ""
+		}
+		return "fail", "missing signature"
+	}
+	if len(values) > 1 {
+		return "fail", "multiple signatures"
+	}
+	signature, err := parseTagSignature(values[0])
+	if err != nil {
+		return "fail", err.Error()
+	}
+	signed := time.Unix(signature.Timestamp, 0)
+	if signed.After(now.Add(SIGNATURE_CLOCK_SKEW)) {
+		return "fail", "timestamp in the future"
+	}
+	if rules.SignatureMaxAge > 0 && now.Sub(signed) > rules.SignatureMaxAge {
+		return "fail", "signature expired"
+	}
+	for _, name := range present {
+		covered := false
+		for _, signed := range signature.Names {
+			if strings.EqualFold(name, signed) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return "fail", name + " not signed"
+		}
+	}
+	expected := computeSignature(rules.VerifyKey, signature.Timestamp, header, signature.Names)
+	if !hmac.Equal([]byte(expected), []byte(signature.Signature)) {
+		return "fail", "invalid signature"
+	}
+	return "pass", ""
+}
+
+// verifySignature flags or strips signed headers with a missing or invalid
+// signature; received status headers are removed as they may be forged
+func (f *Filter) verifySignature(log *slog.Logger, message *Message, header []string, record *AuditRecord) []string {
+	rules := message.Rules
+	status := rules.SignatureHeader + "-Status"
+	header = f.removeHeaderFields(log, message, record, "verify", header, status)
+	result, reason := VerifyTagSignature(rules, header, time.Now())
+	log.Info("signature verified", "rule", "verify", "result", result, "reason", reason)
+	if result == "none" {
+		return header
+	}
+	if rules.VerifyAction == "strip" {
+		if result == "pass" {
+			return header
+		}
+		return f.removeHeaderFields(log, message, record, "verify", header, append([]string{rules.SignatureHeader}, rules.SignHeaders...)...)
+	}
+	value := result
+	if reason != "" {
+		value += " (" + reason + ")"
+	}
+	line := status + ": " + value
+	if rules.IsDryRun("verify") {
+		log.Info("dry-run: header not added", "rule", "verify", "action", "add-header", "header", line, "dry_run", true)
+		message.Actions = append(message.Actions, Action{"verify", "dry-run add-header", line})
+		f.Metrics.dryRun("verify", "add-header")
+		return header
+	}
+	log.Info("header added", "rule", "verify", "action", "add-header", "header", line)
+	message.Actions = append(message.Actions, Action{"verify", "add-header", line})
+	f.Metrics.headerAdded("verify", status)
+	record.Added = append(record.Added, line)
+	if !slices.Contains(record.Rules, "verify") {
+		record.Rules = append(record.Rules, "verify")
+	}
+	return append(header, line)
+}
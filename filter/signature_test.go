@@ -0,0 +1,108 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignature(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	keyFile := filepath.Join(t.TempDir(), "secret")
+	require.Nil(t, os.WriteFile(keyFile, []byte("sekrit\n"), 0600))
+	ViperSet("sign-key-file", keyFile)
+	ViperSet("sign-header", []string{"X-Internal-Origin"})
+	defer func() {
+		ViperSet("sign-key-file", "")
+		ViperSet("sign-header", []string{})
+		ViperSet("verify-signature", false)
+		ViperSet("verify-action", "flag")
+	}()
+
+	message, err := ReadMessage(strings.NewReader("Message-ID: <1234@example.org>\nSubject: signed\n\nbody\n"))
+	require.Nil(t, err)
+	env := Envelope{From: "fromuser@example.org", To: []string{"touser@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Internal-Origin", "yes")
+	result, err := Simulate(f, &env, message)
+	require.Nil(t, err)
+	signed := result.Lines
+	require.Equal(t, "X-Internal-Origin: yes", signed[2])
+	require.True(t, strings.HasPrefix(signed[3], "X-Addheader-Signature: v=1; t="), signed[3])
+	require.True(t, strings.Contains(signed[3], "; h=X-Internal-Origin; s="), signed[3])
+
+	// received copies of signed headers are removed before signing
+	forged, err := ReadMessage(strings.NewReader("Message-ID: <1234@example.org>\nX-Internal-Origin: forged\nX-Addheader-Signature: v=1; t=1; h=X-Internal-Origin; s=forged\nSubject: signed\n\nbody\n"))
+	require.Nil(t, err)
+	result, err = Simulate(f, &env, forged)
+	require.Nil(t, err)
+	require.Equal(t, "Subject: signed", result.Lines[1])
+	require.Equal(t, "X-Internal-Origin: yes", result.Lines[2])
+	require.True(t, strings.HasPrefix(result.Lines[3], "X-Addheader-Signature: v=1; t="), result.Lines[3])
+	require.NotContains(t, strings.Join(result.Lines, "\n"), "forged")
+	require.Equal(t, []Action{
+		{"sign", "remove-header", "X-Internal-Origin: forged"},
+		{"sign", "remove-header", "X-Addheader-Signature: v=1; t=1; h=X-Internal-Origin; s=forged"},
+		{"headers", "add-header", "X-Internal-Origin: yes"},
+		{"sign", "add-header", result.Lines[3]},
+	}, result.Actions)
+	forgedSigned := result.Lines
+
+	verify := func(lines []string) []string {
+		result, err := Simulate(NewFilter(nil, nil), &env, lines)
+		require.Nil(t, err)
+		return result.Lines
+	}
+	ViperSet("verify-signature", true)
+	lines := verify(signed)
+	require.Equal(t, "X-Addheader-Signature-Status: pass", lines[4])
+	lines = verify(forgedSigned)
+	require.Equal(t, "X-Addheader-Signature-Status: pass", lines[4])
+
+	tampered := append([]string{}, signed...)
+	tampered[2] = "X-Internal-Origin: no"
+	lines = verify(tampered)
+	require.Equal(t, "X-Addheader-Signature-Status: fail (invalid signature)", lines[4])
+
+	spoofed := []string{"Subject: spoofed", "X-Internal-Origin: yes", "", "body"}
+	lines = verify(spoofed)
+	require.Equal(t, "X-Addheader-Signature-Status: fail (missing signature)", lines[2])
+
+	lines = verify([]string{"Subject: plain", "", "body"})
+	require.Equal(t, []string{"Subject: plain", "", "body"}, lines)
+
+	// received status headers are forged
+	lines = verify([]string{"Subject: plain", "X-Addheader-Signature-Status: pass", "", "body"})
+	require.Equal(t, []string{"Subject: plain", "", "body"}, lines)
+	forgedStatus := append([]string{"X-Addheader-Signature-Status: pass"}, spoofed...)
+	lines = verify(forgedStatus)
+	require.Equal(t, []string{"Subject: spoofed", "X-Internal-Origin: yes", "X-Addheader-Signature-Status: fail (missing signature)", "", "body"}, lines)
+
+	// signatures older than max-age are replays
+	ViperSet("max-age", 3600)
+	defer ViperSet("max-age", 0)
+	key := []byte("sekrit")
+	replayed := []string{"Message-ID: <5678@example.org>", "Subject: replayed", "X-Internal-Origin: yes"}
+	for _, age := range []time.Duration{2 * time.Hour, -time.Hour} {
+		timestamp := time.Now().Add(-age).Unix()
+		signature := tagSignature{Timestamp: timestamp, Names: []string{"X-Internal-Origin"}}
+		signature.Signature = computeSignature(key, timestamp, replayed, signature.Names)
+		lines = verify(append(append([]string{}, replayed...), "X-Addheader-Signature: "+signature.String(), "", "body"))
+		if age > 0 {
+			require.Equal(t, "X-Addheader-Signature-Status: fail (signature expired)", lines[4])
+		} else {
+			require.Equal(t, "X-Addheader-Signature-Status: fail (timestamp in the future)", lines[4])
+		}
+	}
+	lines = verify(signed)
+	require.Equal(t, "X-Addheader-Signature-Status: pass", lines[4])
+
+	ViperSet("verify-action", "strip")
+	lines = verify(tampered)
+	require.Equal(t, []string{"Message-ID: <1234@example.org>", "Subject: signed", "", "body"}, lines)
+	lines = verify(signed)
+	require.Equal(t, signed, lines)
+}
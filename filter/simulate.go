@@ -0,0 +1,147 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Envelope describes the SMTP session used to simulate delivery of a message
+type Envelope struct {
+	From     string
+	To       []string
+	Remote   string
+	Local    string
+	RDNS     string
+	Helo     string
+	AuthUser string
+}
+
+// SimulateResult is the filtered message and the actions taken
+type SimulateResult struct {
+	Lines   []string
+	Actions []Action
+}
+
+const simulateSession = "0000000000000001"
+const simulateMessage = "00000001"
+const simulateToken = "0000000000000002"
+
+// SimulateEvents returns the smtpd protocol lines for delivery of message
+func SimulateEvents(env *Envelope, message []string) []string {
+	timestamp := fmt.Sprintf("%.6f", float64(time.Now().UnixMicro())/1e6)
+	report := func(event string, args ...string) string {
+		return strings.Join(append([]string{"report", "0.7", timestamp, "smtp-in", event, simulateSession}, args...), "|")
+	}
+	lines := []string{
+		"config|smtpd-version|7.7.0",
+		"config|protocol|0.7",
+		"config|subsystem|smtp-in",
+		"config|ready",
+		report("link-connect", env.RDNS, "pass", env.Remote, env.Local),
+	}
+	if env.Helo != "" {
+		lines = append(lines, report("link-identify", "EHLO", env.Helo))
+	}
+	if env.AuthUser != "" {
+		lines = append(lines, report("link-auth", "pass", env.AuthUser))
+	}
+	lines = append(lines,
+		report("tx-begin", simulateMessage),
+		report("tx-mail", simulateMessage, "ok", env.From),
+	)
+	for _, rcpt := range env.To {
+		lines = append(lines, report("tx-rcpt", simulateMessage, "ok", rcpt))
+	}
+	lines = append(lines, report("tx-data", simulateMessage, "ok"))
+	prefix := strings.Join([]string{"filter", "0.7", timestamp, "smtp-in", "data-line", simulateSession, simulateToken}, "|")
+	for _, line := range stuffLines(message) {
+		lines = append(lines, prefix+"|"+line)
+	}
+	lines = append(lines,
+		prefix+"|.",
+		report("tx-commit", simulateMessage, "0"),
+		report("link-disconnect"),
+	)
+	return lines
+}
+
+// ReadMessage reads an RFC 5322 message, returning its lines without line endings
+func ReadMessage(reader io.Reader) ([]string, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimSuffix(scanner.Text(), "\r"))
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// Simulate runs message through a filter connected by pipes, as smtpd would
+func Simulate(f *Filter, env *Envelope, message []string) (*SimulateResult, error) {
+	filterIn, testOut, err := os.Pipe()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	defer filterIn.Close()
+	testIn, filterOut, err := os.Pipe()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	defer testIn.Close()
+	defer filterOut.Close()
+
+	f.input = bufio.NewScanner(filterIn)
+	f.output = filterOut
+	actions := make(chan []Action, 1)
+	f.OnMessage = func(session *Session, message *Message) {
+		actions <- message.Actions
+	}
+	done := make(chan struct{})
+	go func() {
+		f.Run()
+		close(done)
+	}()
+	go func() {
+		defer testOut.Close()
+		for _, line := range SimulateEvents(env, message) {
+			_, err := testOut.WriteString(line + "\n")
+			if err != nil {
+				slog.Warn("simulate: write failed", "error", err)
+				return
+			}
+		}
+	}()
+
+	result := SimulateResult{Lines: []string{}}
+	prefix := "filter-dataline|" + simulateSession + "|" + simulateToken + "|"
+	scanner := bufio.NewScanner(testIn)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		line = strings.TrimPrefix(line, prefix)
+		if line == "." {
+			result.Lines = unstuffLines(result.Lines)
+			result.Actions = <-actions
+			<-done
+			return &result, nil
+		}
+		result.Lines = append(result.Lines, line)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, Fatal(err)
+	}
+	return nil, Fatalf("unexpected EOF on filter output")
+}
@@ -0,0 +1,36 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"log"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSimulate(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	message, err := ReadMessage(strings.NewReader("To: touser@localdomain.ext\r\nSubject: simulate\r\n\r\n.leading dot\r\n"))
+	require.Nil(t, err)
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Literal", "{{.Session.Helo}}")
+	env := Envelope{
+		From:   "fromuser@example.org",
+		To:     []string{"touser@localdomain.ext"},
+		Remote: "1.2.3.4:11223",
+		Local:  "5.6.7.8:25",
+		RDNS:   "sendhost.example.org",
+		Helo:   "sendhost.example.org",
+	}
+	result, err := Simulate(f, &env, message)
+	require.Nil(t, err)
+	log.Println(FormatJSON(result))
+	require.Equal(t, []string{
+		"To: touser@localdomain.ext",
+		"Subject: simulate",
+		"X-Literal: {{.Session.Helo}}",
+		"",
+		".leading dot",
+	}, result.Lines)
+	require.Equal(t, []Action{{"headers", "add-header", "X-Literal: {{.Session.Helo}}"}}, result.Actions)
+}
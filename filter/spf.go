@@ -0,0 +1,725 @@
+package filter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RFC 7208 processing limits
+const SPF_MAX_LOOKUPS = 10
+const SPF_MAX_VOID_LOOKUPS = 2
+const SPF_MAX_NAMES = 10
+
+// SPF result values
+var spfResults = []string{"none", "neutral", "pass", "fail", "softfail", "temperror", "permerror"}
+
+var spfQualifiers = map[byte]string{'+': "pass", '-': "fail", '~': "softfail", '?': "neutral"}
+
+var spfMechanisms = map[string]bool{"all": true, "include": true, "a": true, "mx": true, "ptr": true, "ip4": true, "ip6": true, "exists": true}
+
+var spfModifierName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+// SPFResult is the outcome of an SPF check of the MAIL FROM or HELO identity
+type SPFResult struct {
+	Result   string
+	Reason   string
+	Identity string
+	Sender   string
+	Domain   string
+	ClientIP string
+	Helo     string
+}
+
+// String formats the result as an Authentication-Results resinfo
+func (r *SPFResult) String() string {
+	s := "spf=" + r.Result
+	if r.Reason != "" {
+		s += " (" + r.Reason + ")"
+	}
+	if r.Identity == "helo" {
+		return s + " smtp.helo=" + r.Helo
+	}
+	return s + " smtp.mailfrom=" + r.Sender
+}
+
+// Header returns the Received-SPF header field for the result
+func (r *SPFResult) Header(receiver string) string {
+	var comment string
+	switch r.Result {
+	case "pass":
+		comment = fmt.Sprintf("domain of %s designates %s as permitted sender", r.Sender, r.ClientIP)
+	case "fail", "softfail":
+		comment = fmt.Sprintf("domain of %s does not designate %s as permitted sender", r.Sender, r.ClientIP)
+	case "neutral":
+		comment = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", r.ClientIP, r.Sender)
+	case "none":
+		comment = fmt.Sprintf("domain of %s does not provide an SPF record", r.Sender)
+	default:
+		comment = fmt.Sprintf("error in processing during lookup of %s", r.Sender)
+	}
+	header := fmt.Sprintf("Received-SPF: %s (%s: %s) receiver=%s; client-ip=%s; envelope-from=\"%s\";", r.Result, receiver, comment, receiver, r.ClientIP, r.Sender)
+	if r.Helo != "" {
+		header += " helo=" + r.Helo + ";"
+	}
+	header += " identity=" + r.Identity + ";"
+	if r.Result == "temperror" || r.Result == "permerror" {
+		header += fmt.Sprintf(" problem=\"%s\";", r.Reason)
+	}
+	return header
+}
+
+// spfError terminates evaluation with a temperror or permerror result
+type spfError struct {
+	result string
+	reason string
+}
+
+func (e *spfError) Error() string {
+	return e.result + ": " + e.reason
+}
+
+func permError(format string, args ...any) error {
+	return &spfError{"permerror", fmt.Sprintf(format, args...)}
+}
+
+// spfTerm is a parsed SPF mechanism or modifier
+type spfTerm struct {
+	qualifier string
+	name      string
+	value     string
+	cidr4     int
+	cidr6     int
+}
+
+// spfChecker holds the state of one check_host() evaluation, including
+// the lookup counts shared by all included records
+type spfChecker struct {
+	ctx      context.Context
+	resolver Resolver
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+	voids    int
+}
+
+// CheckSPF evaluates the SPF record of the sender domain for the client
+// address; an empty sender is checked as postmaster at the HELO name
+func CheckSPF(ctx context.Context, resolver Resolver, ip net.IP, sender, helo string) *SPFResult {
+	result := &SPFResult{Identity: "mailfrom", Sender: sender, ClientIP: ip.String(), Helo: helo}
+	if sender == "" {
+		result.Identity = "helo"
+		sender = "postmaster@" + helo
+	}
+	local, domain, ok := strings.Cut(sender, "@")
+	if !ok {
+		domain = local
+		sender = "postmaster@" + domain
+	}
+	result.Sender = sender
+	result.Domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if !validSPFDomain(result.Domain) {
+		result.Result = "none"
+		result.Reason = "invalid domain"
+		return result
+	}
+	checker := &spfChecker{
+		ctx:      ctx,
+		resolver: resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+	result.Result, result.Reason = checker.checkHost(result.Domain)
+	return result
+}
+
+// validSPFDomain returns true if the domain is a multi-label domain name
+func validSPFDomain(domain string) bool {
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// isNotFound returns true for NXDOMAIN and empty answers
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// record returns the single v=spf1 TXT record of the domain
+func (c *spfChecker) record(domain string) (string, error) {
+	records, err := c.resolver.LookupTXT(c.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", nil
+		}
+		return "", &spfError{"temperror", fmt.Sprintf("TXT lookup for %s failed", domain)}
+	}
+	found := []string{}
+	for _, record := range records {
+		lower := strings.ToLower(record)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			found = append(found, record)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return found[0], nil
+	}
+	return "", permError("multiple SPF records for %s", domain)
+}
+
+// checkHost implements the RFC 7208 check_host() function
+func (c *spfChecker) checkHost(domain string) (string, string) {
+	result, reason, err := c.evaluate(domain)
+	if err != nil {
+		var spfErr *spfError
+		if errors.As(err, &spfErr) {
+			return spfErr.result, spfErr.reason
+		}
+		return "permerror", err.Error()
+	}
+	return result, reason
+}
+
+// parseSPF parses the terms of an SPF record, returning the mechanisms
+// and the redirect target
+func parseSPF(record string) ([]*spfTerm, string, error) {
+	terms := []*spfTerm{}
+	redirect := ""
+	seen := make(map[string]bool)
+	for _, field := range strings.Fields(record)[1:] {
+		term := &spfTerm{qualifier: "pass", cidr4: 32, cidr6: 128}
+		text := field
+		if qualifier, ok := spfQualifiers[text[0]]; ok {
+			term.qualifier = qualifier
+			text = text[1:]
+		}
+		end := strings.IndexAny(text, ":/")
+		if end < 0 {
+			end = len(text)
+		}
+		term.name = strings.ToLower(text[:end])
+		if !spfMechanisms[term.name] {
+			name, value, ok := strings.Cut(field, "=")
+			if !ok || !spfModifierName.MatchString(name) {
+				return nil, "", permError("unknown mechanism '%s'", field)
+			}
+			name = strings.ToLower(name)
+			if seen[name] && (name == "redirect" || name == "exp") {
+				return nil, "", permError("duplicate %s modifier", name)
+			}
+			seen[name] = true
+			// exp and unknown modifiers are ignored
+			if name == "redirect" {
+				redirect = value
+			}
+			continue
+		}
+		rest := text[end:]
+		if strings.HasPrefix(rest, ":") {
+			rest = rest[1:]
+			term.value, rest, _ = strings.Cut(rest, "/")
+			if rest != "" || strings.HasSuffix(text, "/") {
+				rest = "/" + rest
+			}
+			if term.value == "" {
+				return nil, "", permError("empty argument in '%s'", field)
+			}
+		}
+		switch term.name {
+		case "all":
+			if rest != "" || term.value != "" {
+				return nil, "", permError("invalid mechanism '%s'", field)
+			}
+		case "include", "exists":
+			if rest != "" || term.value == "" {
+				return nil, "", permError("invalid mechanism '%s'", field)
+			}
+		case "ptr":
+			if rest != "" {
+				return nil, "", permError("invalid mechanism '%s'", field)
+			}
+		case "ip4", "ip6":
+			if term.value == "" {
+				return nil, "", permError("invalid mechanism '%s'", field)
+			}
+			term.value += rest
+			if !strings.Contains(term.value, "/") {
+				term.value += map[string]string{"ip4": "/32", "ip6": "/128"}[term.name]
+			}
+			ip, _, err := net.ParseCIDR(term.value)
+			if err != nil || (term.name == "ip4") != (ip.To4() != nil) {
+				return nil, "", permError("invalid network in '%s'", field)
+			}
+		case "a", "mx":
+			err := parseDualCIDR(rest, term)
+			if err != nil {
+				return nil, "", permError("invalid prefix length in '%s'", field)
+			}
+		}
+		terms = append(terms, term)
+	}
+	return terms, redirect, nil
+}
+
+// parseDualCIDR parses the /ip4-cidr//ip6-cidr suffix of a or mx
+func parseDualCIDR(rest string, term *spfTerm) error {
+	if rest == "" {
+		return nil
+	}
+	v4, v6, dual := strings.Cut(rest, "//")
+	if v4 != "" {
+		if !strings.HasPrefix(v4, "/") {
+			return fmt.Errorf("invalid prefix")
+		}
+		bits, err := strconv.Atoi(v4[1:])
+		if err != nil || bits < 0 || bits > 32 {
+			return fmt.Errorf("invalid prefix")
+		}
+		term.cidr4 = bits
+	}
+	if dual {
+		bits, err := strconv.Atoi(v6)
+		if err != nil || bits < 0 || bits > 128 {
+			return fmt.Errorf("invalid prefix")
+		}
+		term.cidr6 = bits
+	}
+	return nil
+}
+
+// evaluate the SPF record of the domain for the client address
+func (c *spfChecker) evaluate(domain string) (string, string, error) {
+	record, err := c.record(domain)
+	if err != nil {
+		return "", "", err
+	}
+	if record == "" {
+		return "none", "", nil
+	}
+	terms, redirect, err := parseSPF(record)
+	if err != nil {
+		return "", "", err
+	}
+	for _, term := range terms {
+		match, err := c.match(domain, term)
+		if err != nil {
+			return "", "", err
+		}
+		if match {
+			return term.qualifier, fmt.Sprintf("matched %s of %s", term.name, domain), nil
+		}
+	}
+	if redirect != "" {
+		err := c.countLookup()
+		if err != nil {
+			return "", "", err
+		}
+		target, err := c.expandDomain(redirect, domain)
+		if err != nil {
+			return "", "", err
+		}
+		result, reason, err := c.evaluate(target)
+		if err != nil {
+			return "", "", err
+		}
+		if result == "none" {
+			return "", "", permError("redirect to %s without SPF record", target)
+		}
+		return result, reason, nil
+	}
+	return "neutral", "", nil
+}
+
+// countLookup counts a DNS querying term against the lookup limit
+func (c *spfChecker) countLookup() error {
+	c.lookups++
+	if c.lookups > SPF_MAX_LOOKUPS {
+		return permError("too many DNS lookups")
+	}
+	return nil
+}
+
+// lookupError maps a failed lookup to a void lookup or a temperror
+func (c *spfChecker) lookupError(name string, err error) error {
+	if !isNotFound(err) {
+		return &spfError{"temperror", fmt.Sprintf("lookup for %s failed", name)}
+	}
+	c.voids++
+	if c.voids > SPF_MAX_VOID_LOOKUPS {
+		return permError("too many void DNS lookups")
+	}
+	return nil
+}
+
+// addresses returns the addresses of the host, or nil for a void lookup
+func (c *spfChecker) addresses(host string) ([]net.IP, error) {
+	addrs, err := c.resolver.LookupIPAddr(c.ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = notFound(host)
+	}
+	if err != nil {
+		return nil, c.lookupError(host, err)
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// cidrMatch returns true if the client address is in the network of addr
+func cidrMatch(ip, addr net.IP, cidr4, cidr6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		addr4 := addr.To4()
+		if addr4 == nil {
+			return false
+		}
+		mask := net.CIDRMask(cidr4, 32)
+		return ip4.Mask(mask).Equal(addr4.Mask(mask))
+	}
+	if addr.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(cidr6, 128)
+	return ip.To16().Mask(mask).Equal(addr.To16().Mask(mask))
+}
+
+// match evaluates one mechanism
+func (c *spfChecker) match(domain string, term *spfTerm) (bool, error) {
+	target := domain
+	switch term.name {
+	case "include", "a", "mx", "ptr", "exists":
+		err := c.countLookup()
+		if err != nil {
+			return false, err
+		}
+		if term.value != "" {
+			target, err = c.expandDomain(term.value, domain)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	switch term.name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		_, network, _ := net.ParseCIDR(term.value)
+		if (term.name == "ip4") != (c.ip.To4() != nil) {
+			return false, nil
+		}
+		return network.Contains(c.ip), nil
+	case "include":
+		result, _, err := c.evaluate(target)
+		if err != nil {
+			return false, err
+		}
+		switch result {
+		case "pass":
+			return true, nil
+		case "none":
+			return false, permError("include of %s without SPF record", target)
+		}
+		return false, nil
+	case "a":
+		addrs, err := c.addresses(target)
+		if err != nil {
+			return false, err
+		}
+		for _, addr := range addrs {
+			if cidrMatch(c.ip, addr, term.cidr4, term.cidr6) {
+				return true, nil
+			}
+		}
+	case "mx":
+		mxs, err := c.resolver.LookupMX(c.ctx, target)
+		if err == nil && len(mxs) == 0 {
+			err = notFound(target)
+		}
+		if err != nil {
+			return false, c.lookupError(target, err)
+		}
+		if len(mxs) > SPF_MAX_NAMES {
+			return false, permError("too many MX records for %s", target)
+		}
+		for _, mx := range mxs {
+			addrs, err := c.addresses(mx.Host)
+			if err != nil {
+				return false, err
+			}
+			for _, addr := range addrs {
+				if cidrMatch(c.ip, addr, term.cidr4, term.cidr6) {
+					return true, nil
+				}
+			}
+		}
+	case "ptr":
+		for _, name := range c.validatedNames() {
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if name == target || strings.HasSuffix(name, "."+target) {
+				return true, nil
+			}
+		}
+	case "exists":
+		addrs, err := c.addresses(target)
+		if err != nil {
+			return false, err
+		}
+		for _, addr := range addrs {
+			if addr.To4() != nil {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// validatedNames returns the PTR names of the client address that
+// resolve back to it; lookup failures are ignored
+func (c *spfChecker) validatedNames() []string {
+	names, err := c.resolver.LookupAddr(c.ctx, c.ip.String())
+	if err != nil {
+		return []string{}
+	}
+	validated := []string{}
+	for i, name := range names {
+		if i == SPF_MAX_NAMES {
+			break
+		}
+		addrs, err := c.resolver.LookupIPAddr(c.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(c.ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+	return validated
+}
+
+// expandDomain expands the macros of a domain-spec, truncating the
+// result to 253 characters by removing labels from the left
+func (c *spfChecker) expandDomain(spec, domain string) (string, error) {
+	expanded, err := c.expand(spec, domain)
+	if err != nil {
+		return "", err
+	}
+	expanded = strings.ToLower(strings.TrimSuffix(expanded, "."))
+	for len(expanded) > 253 {
+		_, rest, ok := strings.Cut(expanded, ".")
+		if !ok {
+			break
+		}
+		expanded = rest
+	}
+	if !validSPFDomain(expanded) {
+		return "", permError("invalid domain '%s'", expanded)
+	}
+	return expanded, nil
+}
+
+// expand the RFC 7208 section 7 macros of a macro-string
+func (c *spfChecker) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", permError("incomplete macro in '%s'", spec)
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", permError("invalid macro in '%s'", spec)
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", permError("invalid macro in '%s'", spec)
+		}
+		value, err := c.macro(spec[i+1:i+end], domain)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		i += end
+	}
+	return b.String(), nil
+}
+
+// macro expands the body of one %{...} macro
+func (c *spfChecker) macro(body, domain string) (string, error) {
+	letter := body[0]
+	local, senderDomain, _ := strings.Cut(c.sender, "@")
+	var value string
+	switch letter | 0x20 {
+	case 's':
+		value = c.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = senderDomain
+	case 'd':
+		value = domain
+	case 'i':
+		value = macroIP(c.ip)
+	case 'p':
+		// RFC 7208 discourages p, it is not looked up
+		value = "unknown"
+	case 'v':
+		value = "in-addr"
+		if c.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = c.helo
+	default:
+		return "", permError("invalid macro letter '%c'", letter)
+	}
+	transformers := body[1:]
+	digits := 0
+	for digits < len(transformers) && transformers[digits] >= '0' && transformers[digits] <= '9' {
+		digits++
+	}
+	keep := 0
+	if digits > 0 {
+		n, err := strconv.Atoi(transformers[:digits])
+		if err != nil || n == 0 {
+			return "", permError("invalid macro transformer '%s'", body)
+		}
+		keep = n
+	}
+	transformers = transformers[digits:]
+	reverse := false
+	if strings.HasPrefix(transformers, "r") || strings.HasPrefix(transformers, "R") {
+		reverse = true
+		transformers = transformers[1:]
+	}
+	delimiters := "."
+	if transformers != "" {
+		if strings.Trim(transformers, ".-+,/_=") != "" {
+			return "", permError("invalid macro delimiter '%s'", body)
+		}
+		delimiters = transformers
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	value = strings.Join(parts, ".")
+	if letter >= 'A' && letter <= 'Z' {
+		value = escapeMacro(value)
+	}
+	return value, nil
+}
+
+// escapeMacro URL encodes all but the RFC 3986 unreserved characters
+func escapeMacro(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+// macroIP formats the client address for the i macro, IPv6 addresses
+// as dot separated nibbles
+func macroIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	nibbles := []string{}
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// remoteIP returns the client address of the session, or nil for local sessions
+func remoteIP(session *Session) net.IP {
+	if strings.HasPrefix(session.Remote, "unix:") {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(session.Remote)
+	if err != nil {
+		host = strings.Trim(session.Remote, "[]")
+	}
+	return net.ParseIP(host)
+}
+
+// buildSPF reads the SPF options
+func (r *RuleSet) buildSPF() []error {
+	r.SPF = ViperGetBool("spf")
+	return []error{}
+}
+
+// spfCheck evaluates SPF for the message sender of an external session,
+// prepending a Received-SPF header
+func (f *Filter) spfCheck(log *slog.Logger, session *Session, message *Message, header []string, record *AuditRecord) []string {
+	ip := remoteIP(session)
+	if ip == nil || !message.Rules.IsExternal(session) {
+		log.Debug("SPF not checked for internal session", "rule", "spf", "remote", session.Remote)
+		return header
+	}
+	resolver, ctx, cancel := f.lookupContext(message)
+	defer cancel()
+	message.SPF = CheckSPF(ctx, resolver, ip, message.From, session.Helo)
+	result := message.SPF
+	log.Info("SPF checked", "rule", "spf", "result", result.Result, "reason", result.Reason, "identity", result.Identity, "domain", result.Domain)
+	line := result.Header(message.Rules.AuthServId)
+	if message.Rules.IsDryRun("spf") {
+		log.Info("dry-run: header not added", "rule", "spf", "action", "add-header", "header", line, "dry_run", true)
+		message.Actions = append(message.Actions, Action{"spf", "dry-run add-header", line})
+		f.Metrics.dryRun("spf", "add-header")
+		return header
+	}
+	log.Info("header added", "rule", "spf", "action", "add-header", "header", line)
+	message.Actions = append(message.Actions, Action{"spf", "add-header", line})
+	f.Metrics.headerAdded("spf", "Received-SPF")
+	record.Added = append(record.Added, line)
+	record.Rules = append(record.Rules, "spf")
+	return append(foldHeader(line), header...)
+}
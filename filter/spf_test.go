@@ -0,0 +1,199 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func spfResolver() *MemoryResolver {
+	resolver := NewMemoryResolver()
+	resolver.TXT["example.org"] = []string{"v=spf1 ip4:1.2.3.0/24 include:_spf.example.net -all"}
+	resolver.TXT["_spf.example.net"] = []string{"v=spf1 a:relay.example.net mx ~all"}
+	resolver.Addr["relay.example.net"] = []string{"10.1.1.1", "2001:db8::1"}
+	resolver.MX["_spf.example.net"] = []string{"mx1.example.net"}
+	resolver.Addr["mx1.example.net"] = []string{"10.2.2.2"}
+	resolver.TXT["redirect.example.com"] = []string{"unrelated txt record", "v=spf1 redirect=example.org"}
+	resolver.TXT["dual.example.com"] = []string{"v=spf1 a:relay.example.net/16//32 ?all"}
+	resolver.TXT["macro.example.com"] = []string{"v=spf1 exists:%{ir}.%{l1r-}.%{d2}.spf.example.com -all"}
+	resolver.Addr["5.4.3.2.list.example.com.spf.example.com"] = []string{"127.0.0.2"}
+	resolver.TXT["ptr.example.com"] = []string{"v=spf1 ptr -all"}
+	resolver.PTR["6.6.6.6"] = []string{"host.ptr.example.com", "fake.other.org"}
+	resolver.Addr["host.ptr.example.com"] = []string{"6.6.6.6"}
+	resolver.TXT["helo.example.com"] = []string{"v=spf1 +a -all"}
+	resolver.Addr["helo.example.com"] = []string{"7.7.7.7"}
+	resolver.TXT["multiple.example.com"] = []string{"v=spf1 -all", "v=spf1 +all"}
+	resolver.TXT["syntax.example.com"] = []string{"v=spf1 ip4:1.2.3 -all"}
+	resolver.TXT["void.example.com"] = []string{"v=spf1 a:no1.example.com a:no2.example.com a:no3.example.com -all"}
+	resolver.TXT["broken.example.com"] = []string{"v=spf1 include:missing.example.com -all"}
+	resolver.TXT["v6.example.com"] = []string{"v=spf1 ip6:2001:db8:1::/48 -all"}
+	// a chain of includes exceeding the lookup limit
+	for i := 0; i < 12; i++ {
+		resolver.TXT[fmt.Sprintf("loop%d.example.com", i)] = []string{fmt.Sprintf("v=spf1 include:loop%d.example.com -all", i+1)}
+	}
+	resolver.TXT["loop12.example.com"] = []string{"v=spf1 +all"}
+	return resolver
+}
+
+func TestCheckSPF(t *testing.T) {
+	resolver := spfResolver()
+	check := func(ip, sender, helo string) *SPFResult {
+		return CheckSPF(context.Background(), resolver, net.ParseIP(ip), sender, helo)
+	}
+	require.Equal(t, "pass", check("1.2.3.4", "fromuser@example.org", "sendhost.example.org").Result)
+	require.Equal(t, "fail", check("9.9.9.9", "fromuser@example.org", "sendhost.example.org").Result)
+	require.Equal(t, "none", check("1.2.3.4", "fromuser@nospf.example.org", "").Result)
+
+	// include matches a and mx of the included record
+	require.Equal(t, "pass", check("10.1.1.1", "fromuser@example.org", "").Result)
+	require.Equal(t, "pass", check("2001:db8::1", "fromuser@example.org", "").Result)
+	require.Equal(t, "pass", check("10.2.2.2", "fromuser@example.org", "").Result)
+
+	// redirect uses the result of the target record
+	result := check("1.2.3.4", "fromuser@redirect.example.com", "")
+	require.Equal(t, "pass", result.Result)
+	require.Equal(t, "redirect.example.com", result.Domain)
+	require.Equal(t, "fail", check("9.9.9.9", "fromuser@redirect.example.com", "").Result)
+
+	// dual cidr lengths
+	require.Equal(t, "pass", check("10.1.200.200", "fromuser@dual.example.com", "").Result)
+	require.Equal(t, "pass", check("2001:db8::ffff", "fromuser@dual.example.com", "").Result)
+	require.Equal(t, "neutral", check("10.2.1.1", "fromuser@dual.example.com", "").Result)
+
+	// macros: reversed ip, reversed local part split on '-', rightmost domain labels
+	require.Equal(t, "pass", check("2.3.4.5", "list-bounces@macro.example.com", "").Result)
+	require.Equal(t, "fail", check("2.3.4.6", "list-bounces@macro.example.com", "").Result)
+
+	// ptr matches only validated names
+	require.Equal(t, "pass", check("6.6.6.6", "fromuser@ptr.example.com", "").Result)
+
+	// the null sender is checked as postmaster at the HELO name
+	result = check("7.7.7.7", "", "helo.example.com")
+	require.Equal(t, "pass", result.Result)
+	require.Equal(t, "helo", result.Identity)
+	require.Equal(t, "postmaster@helo.example.com", result.Sender)
+	require.Equal(t, "spf=pass (matched a of helo.example.com) smtp.helo=helo.example.com", result.String())
+
+	require.Equal(t, "pass", check("2001:db8:1::25", "fromuser@v6.example.com", "").Result)
+	require.Equal(t, "fail", check("1.2.3.4", "fromuser@v6.example.com", "").Result)
+
+	require.Equal(t, "permerror", check("1.2.3.4", "fromuser@multiple.example.com", "").Result)
+	require.Equal(t, "permerror", check("1.2.3.4", "fromuser@syntax.example.com", "").Result)
+	result = check("1.2.3.4", "fromuser@void.example.com", "")
+	require.Equal(t, "permerror", result.Result)
+	require.Equal(t, "too many void DNS lookups", result.Reason)
+	require.Equal(t, "permerror", check("1.2.3.4", "fromuser@broken.example.com", "").Result)
+
+	result = check("1.2.3.4", "fromuser@loop0.example.com", "")
+	require.Equal(t, "permerror", result.Result)
+	require.Equal(t, "too many DNS lookups", result.Reason)
+	require.Equal(t, "pass", check("1.2.3.4", "fromuser@loop3.example.com", "").Result)
+}
+
+func TestSPFMacros(t *testing.T) {
+	// examples from RFC 7208 section 7.4
+	checker := &spfChecker{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+	expand := func(spec string) string {
+		value, err := checker.expand(spec, "email.example.com")
+		require.Nil(t, err, spec)
+		return value
+	}
+	require.Equal(t, "strong-bad@email.example.com", expand("%{s}"))
+	require.Equal(t, "email.example.com", expand("%{o}"))
+	require.Equal(t, "email.example.com", expand("%{d}"))
+	require.Equal(t, "email.example.com", expand("%{d4}"))
+	require.Equal(t, "example.com", expand("%{d2}"))
+	require.Equal(t, "com", expand("%{d1}"))
+	require.Equal(t, "com.example.email", expand("%{dr}"))
+	require.Equal(t, "example.email", expand("%{d2r}"))
+	require.Equal(t, "strong-bad", expand("%{l}"))
+	require.Equal(t, "strong.bad", expand("%{l-}"))
+	require.Equal(t, "strong-bad", expand("%{lr}"))
+	require.Equal(t, "bad.strong", expand("%{lr-}"))
+	require.Equal(t, "strong", expand("%{l1r-}"))
+	require.Equal(t, "3.2.0.192.in-addr._spf.example.com", expand("%{ir}.%{v}._spf.%{d2}"))
+	require.Equal(t, "bad.strong.lp._spf.example.com", expand("%{lr-}.lp._spf.%{d2}"))
+	require.Equal(t, "mx.example.org 100% %20", expand("%{h}%_100%%%_%-"))
+	require.Equal(t, "strong-bad%40email.example.com", expand("%{S}"))
+
+	checker.ip = net.ParseIP("2001:db8::cb01")
+	require.Equal(t, "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com", expand("%{ir}.%{v}._spf.%{d2}"))
+
+	for _, spec := range []string{"%{x}", "%{d0}", "%{d", "%"} {
+		_, err := checker.expand(spec, "email.example.com")
+		require.NotNil(t, err, spec)
+	}
+}
+
+func TestSPFHeader(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := `smtpd_filter_addheader:
+  spf: true
+  rules:
+    - name: spf-fail
+      header:
+        - X-SPF-Failed=yes
+      spf:
+        - fail
+        - softfail
+`
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	ViperSet("authserv-id", "mx.localdomain.ext")
+	defer ViperSet("authserv-id", "")
+
+	message := []string{"Subject: spf", "", "body"}
+	env := Envelope{From: "fromuser@example.org", To: []string{"touser@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25", Helo: "sendhost.example.org"}
+	f := NewFilter(nil, nil)
+	f.Resolver = spfResolver()
+	result, err := Simulate(f, &env, message)
+	require.Nil(t, err)
+	fields := headerFields(result.Lines[:slices.Index(result.Lines, "")])
+	require.Len(t, fields, 2)
+	require.Equal(t, "Received-SPF", fieldName(fields[0]))
+	require.Equal(t, `pass (mx.localdomain.ext: domain of fromuser@example.org designates 1.2.3.4 as permitted sender) receiver=mx.localdomain.ext; client-ip=1.2.3.4; envelope-from="fromuser@example.org"; helo=sendhost.example.org; identity=mailfrom;`, strings.Join(strings.Fields(fieldValue(fields[0])), " "))
+
+	env.Remote = "9.9.9.9:11223"
+	result, err = Simulate(f, &env, message)
+	require.Nil(t, err)
+	fields = headerFields(result.Lines[:slices.Index(result.Lines, "")])
+	require.Len(t, fields, 3)
+	require.True(t, strings.HasPrefix(fieldValue(fields[0]), "fail "))
+	require.Equal(t, []string{"X-SPF-Failed: yes"}, fields[2])
+
+	// authenticated and local sessions are not checked
+	env.AuthUser = "authuser"
+	result, err = Simulate(f, &env, message)
+	require.Nil(t, err)
+	require.Equal(t, message, result.Lines)
+	env.AuthUser = ""
+	env.Remote = "unix:/var/run/smtpd.sock"
+	result, err = Simulate(f, &env, message)
+	require.Nil(t, err)
+	require.Equal(t, message, result.Lines)
+}
+
+func TestSPFConditionRequiresSPF(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	config := `smtpd_filter_addheader:
+  rules:
+    - name: spf-fail
+      header:
+        - X-SPF-Failed=yes
+      spf:
+        - fail
+        - bogus
+`
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	errs := NewFilter(nil, nil).CheckRules()
+	require.Len(t, errs, 2)
+}
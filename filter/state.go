@@ -0,0 +1,82 @@
+package filter
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+)
+
+// State is a snapshot of the filter for diagnostics
+type State struct {
+	Name     string
+	Version  string
+	Time     time.Time
+	Sessions map[string]*Session
+	Metrics  *Metrics
+	Rules    *RuleSet
+}
+
+// StateJSON returns a JSON snapshot of the filter state, taken between
+// protocol lines so sessions are not modified while they are formatted
+func (f *Filter) StateJSON() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return FormatJSON(&State{
+		Name:     f.Name,
+		Version:  Version,
+		Time:     time.Now(),
+		Sessions: f.Sessions,
+		Metrics:  f.Metrics,
+		Rules:    f.Rules(),
+	})
+}
+
+// DumpState writes a state snapshot to the state-file if configured, or to the log
+func (f *Filter) DumpState() error {
+	state := f.StateJSON()
+	filename := ViperGetString("state-file")
+	if filename == "" {
+		f.log.Info("state", "state", state)
+		return nil
+	}
+	temp, err := os.CreateTemp(filepath.Dir(filename), ".state-*")
+	if err != nil {
+		return err
+	}
+	_, err = temp.WriteString(state + "\n")
+	if err != nil {
+		temp.Close()
+		os.Remove(temp.Name())
+		return err
+	}
+	err = temp.Close()
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	err = os.Rename(temp.Name(), filename)
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	f.log.Info("state written", "file", filename)
+	return nil
+}
+
+// dump state on SIGUSR1
+func (f *Filter) watchState() {
+	if len(stateSignals) == 0 {
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, stateSignals...)
+	go func() {
+		for range signals {
+			err := f.DumpState()
+			if err != nil {
+				f.log.Error("state dump failed", "error", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,64 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpState(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	transcript := readTranscript(t)
+
+	var output bytes.Buffer
+	f := NewFilter(nil, &output)
+	f.AddHeader("X-State", "dumped")
+	require.Nil(t, f.swapRules())
+	for _, line := range transcript {
+		if strings.Contains(line, "link-disconnect") {
+			break
+		}
+		f.handleLine(line)
+	}
+
+	filename := filepath.Join(t.TempDir(), "state.json")
+	ViperSet("state-file", filename)
+	defer ViperSet("state-file", "")
+	require.Nil(t, f.DumpState())
+	data, err := os.ReadFile(filename)
+	require.Nil(t, err)
+	var state struct {
+		Version  string
+		Sessions map[string]*Session
+		Metrics  struct {
+			SessionsActive int
+			Messages       map[string]uint64
+			HeadersAdded   map[string]uint64
+		}
+		Rules struct {
+			Headers map[string]string
+		}
+	}
+	require.Nil(t, json.Unmarshal(data, &state))
+	require.Equal(t, Version, state.Version)
+	require.Equal(t, "commit", state.Sessions["deadbeef"].Messages["cafebabe"].State)
+	require.Equal(t, 1, state.Metrics.SessionsActive)
+	require.Equal(t, uint64(1), state.Metrics.Messages["commit"])
+	require.Equal(t, uint64(1), state.Metrics.HeadersAdded["headers/X-State"])
+	require.Equal(t, "dumped", state.Rules.Headers["X-State"])
+
+	// message content is not part of the state
+	f = NewFilter(nil, &output)
+	require.Nil(t, f.swapRules())
+	for _, line := range transcript {
+		if strings.Contains(line, "Subject:") {
+			break
+		}
+		f.handleLine(line)
+	}
+	require.NotContains(t, f.StateJSON(), "From: fromuser@example.org")
+}
@@ -0,0 +1,373 @@
+package filter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// rule database queries time out after this long
+const STORE_QUERY_TIMEOUT = 10 * time.Second
+
+// RULE_STORE_SCHEMA creates a rule database.  Each row of rules is a
+// named rule like an entry of the rules config list; a rule without
+// recipients matches all messages, spf and dmarc are comma separated
+// result lists and disabled rules are ignored.  Mapped headers take their
+// values from the rows of mappings with the same mapping name, or from
+// the smtpd table in table_spec.
+const RULE_STORE_SCHEMA = `
+CREATE TABLE IF NOT EXISTS rules (
+	name TEXT PRIMARY KEY,
+	spf TEXT NOT NULL DEFAULT '',
+	dmarc TEXT NOT NULL DEFAULT '',
+	dry_run INTEGER NOT NULL DEFAULT 0,
+	enabled INTEGER NOT NULL DEFAULT 1
+);
+CREATE TABLE IF NOT EXISTS rule_headers (
+	rule TEXT NOT NULL REFERENCES rules(name),
+	name TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (rule, name)
+);
+CREATE TABLE IF NOT EXISTS rule_recipients (
+	rule TEXT NOT NULL REFERENCES rules(name),
+	pattern TEXT NOT NULL,
+	PRIMARY KEY (rule, pattern)
+);
+CREATE TABLE IF NOT EXISTS mapped_headers (
+	rule TEXT NOT NULL REFERENCES rules(name),
+	name TEXT NOT NULL,
+	key TEXT NOT NULL DEFAULT 'recipient',
+	mode TEXT NOT NULL DEFAULT 'first',
+	separator TEXT NOT NULL DEFAULT ', ',
+	default_value TEXT NOT NULL DEFAULT '',
+	mapping TEXT NOT NULL DEFAULT '',
+	table_spec TEXT NOT NULL DEFAULT '',
+	PRIMARY KEY (rule, name)
+);
+CREATE TABLE IF NOT EXISTS mappings (
+	mapping TEXT NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (mapping, key)
+);
+`
+
+// RuleStore caches the named rules of a SQLite rule database in the form
+// of rules config entries; Read re-reads the database and Replace updates
+// the cache; rules rejected by Reject are not reported as changed
+type RuleStore struct {
+	Path     string
+	db       *sql.DB
+	rules    []any
+	rejected []any
+	mutex    sync.Mutex
+}
+
+// NewRuleStore opens the rule database and loads its rules
+func NewRuleStore(path string) (*RuleStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?mode=ro&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	s := RuleStore{Path: path, db: db}
+	rules, err := s.Read()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s.rules = rules
+	return &s, nil
+}
+
+// Rules returns the cached rules config entries
+func (s *RuleStore) Rules() []any {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.rules
+}
+
+// Read returns the rules in the database without caching them
+func (s *RuleStore) Read() ([]any, error) {
+	rules, err := s.read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.Path, err)
+	}
+	return rules, nil
+}
+
+// Changed returns true if the rules differ from the cached rules and the
+// last rejected rules
+func (s *RuleStore) Changed(rules []any) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return !reflect.DeepEqual(rules, s.rules) && !reflect.DeepEqual(rules, s.rejected)
+}
+
+// Reject records rules that failed to load; nil clears the record
+func (s *RuleStore) Reject(rules []any) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.rejected = rules
+}
+
+// Replace caches the rules, returning the previously cached rules
+func (s *RuleStore) Replace(rules []any) []any {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	previous := s.rules
+	s.rules = rules
+	return previous
+}
+
+func (s *RuleStore) Close() error {
+	return s.db.Close()
+}
+
+// read returns the enabled rules in one read transaction
+func (s *RuleStore) read() ([]any, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), STORE_QUERY_TIMEOUT)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	names := []string{}
+	rules := make(map[string]map[string]any)
+	err = queryRows(ctx, tx, "SELECT name, spf, dmarc, dry_run FROM rules WHERE enabled ORDER BY name", func(rows *sql.Rows) error {
+		var name, spf, dmarc string
+		var dryRun bool
+		err := rows.Scan(&name, &spf, &dmarc, &dryRun)
+		if err != nil {
+			return err
+		}
+		names = append(names, name)
+		rules[name] = map[string]any{
+			"name":          name,
+			"header":        []any{},
+			"recipient":     []any{},
+			"mapped_header": []any{},
+			"spf":           configList(spf),
+			"dmarc":         configList(dmarc),
+			"dry_run":       dryRun,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	appendField := func(rule, field string, value any) {
+		if fields, ok := rules[rule]; ok {
+			fields[field] = append(fields[field].([]any), value)
+		}
+	}
+	err = queryRows(ctx, tx, "SELECT rule, name, value FROM rule_headers ORDER BY rule, name", func(rows *sql.Rows) error {
+		var rule, name, value string
+		err := rows.Scan(&rule, &name, &value)
+		if err == nil {
+			appendField(rule, "header", name+"="+value)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = queryRows(ctx, tx, "SELECT rule, pattern FROM rule_recipients ORDER BY rule, pattern", func(rows *sql.Rows) error {
+		var rule, pattern string
+		err := rows.Scan(&rule, &pattern)
+		if err == nil {
+			appendField(rule, "recipient", pattern)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	mappings := make(map[string]map[string]any)
+	err = queryRows(ctx, tx, "SELECT mapping, key, value FROM mappings", func(rows *sql.Rows) error {
+		var mapping, key, value string
+		err := rows.Scan(&mapping, &key, &value)
+		if err != nil {
+			return err
+		}
+		if mappings[mapping] == nil {
+			mappings[mapping] = make(map[string]any)
+		}
+		mappings[mapping][key] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = queryRows(ctx, tx, "SELECT rule, name, key, mode, separator, default_value, mapping, table_spec FROM mapped_headers ORDER BY rule, name", func(rows *sql.Rows) error {
+		var rule, name, key, mode, separator, defaultValue, mapping, table string
+		err := rows.Scan(&rule, &name, &key, &mode, &separator, &defaultValue, &mapping, &table)
+		if err != nil {
+			return err
+		}
+		header := map[string]any{"name": name, "key": key, "mode": mode, "separator": separator, "default": defaultValue}
+		if table != "" {
+			header["table"] = table
+		}
+		if mapping != "" {
+			values := mappings[mapping]
+			if values == nil {
+				// an empty mapping yields only the default value
+				values = make(map[string]any)
+			}
+			header["map"] = values
+		}
+		appendField(rule, "mapped_header", header)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entries := []any{}
+	for _, name := range names {
+		entries = append(entries, rules[name])
+	}
+	return entries, tx.Commit()
+}
+
+// queryRows calls scan for each row of the query result
+func queryRows(ctx context.Context, tx *sql.Tx, query string, scan func(*sql.Rows) error) error {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		err := scan(rows)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// configList returns the items of a comma separated list as config values
+func configList(value string) []any {
+	items := []any{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ruleStore returns the rule database named by the rules-db option,
+// opening it when the option changes
+func (f *Filter) ruleStore() (*RuleStore, error) {
+	f.storeLock.Lock()
+	defer f.storeLock.Unlock()
+	path := ViperGetString("rules-db")
+	if f.store != nil && f.store.Path != path {
+		f.store.Close()
+		f.store = nil
+	}
+	if path == "" || f.store != nil {
+		return f.store, nil
+	}
+	store, err := NewRuleStore(path)
+	if err != nil {
+		return nil, err
+	}
+	f.log.Info("rule database opened", "file", path, "rules", len(store.Rules()))
+	f.store = store
+	return store, nil
+}
+
+// ruleConfig returns the rules config list followed by the rule database entries
+func (f *Filter) ruleConfig() (any, []error) {
+	config := ViperGet("rules")
+	store, err := f.ruleStore()
+	if err != nil {
+		return config, []error{&ConfigError{"rules-db", ViperGetString("rules-db"), err}}
+	}
+	if store == nil {
+		return config, []error{}
+	}
+	entries, ok := config.([]any)
+	if config != nil && !ok {
+		return config, []error{}
+	}
+	return append(append([]any{}, entries...), store.Rules()...), []error{}
+}
+
+// refreshStore re-reads the rule database and swaps in new rules if it
+// changed; the database is read without holding the reload lock, and the
+// cached rules are replaced only if the new rules load.  Rejected rules
+// are retried only when the database or the config changes.
+func (f *Filter) refreshStore() {
+	f.storeLock.Lock()
+	store := f.store
+	f.storeLock.Unlock()
+	if store == nil {
+		return
+	}
+	rules, err := store.Read()
+	if err != nil {
+		f.log.Warn("rule database refresh failed; keeping cached rules", "file", store.Path, "error", err)
+		return
+	}
+	if !store.Changed(rules) {
+		return
+	}
+	f.log.Info("rule database changed; reloading rules", "file", store.Path)
+	f.reloadLock.Lock()
+	defer f.reloadLock.Unlock()
+	previous := store.Replace(rules)
+	err = f.swapRules()
+	if err != nil {
+		store.Replace(previous)
+		store.Reject(rules)
+		f.log.Error("reload failed; keeping current rules", "error", err)
+	}
+}
+
+// refresh the rule database in the background at the rules-db-refresh
+// interval; called at startup and after each reload, the refresh is
+// restarted when the interval changes and stopped when rules-db is unset
+func (f *Filter) watchStore() {
+	interval := ViperGetInt("rules-db-refresh")
+	if ViperGetString("rules-db") == "" || interval < 0 {
+		interval = 0
+	}
+	if interval == f.storeRefresh {
+		return
+	}
+	if f.storeStop != nil {
+		close(f.storeStop)
+		f.storeStop = nil
+	}
+	f.storeRefresh = interval
+	if interval == 0 {
+		f.log.Info("rule database refresh stopped")
+		return
+	}
+	f.log.Info("refreshing rule database", "file", ViperGetString("rules-db"), "interval_seconds", interval)
+	stop := make(chan struct{})
+	f.storeStop = stop
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f.refreshStore()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
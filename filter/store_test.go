@@ -0,0 +1,123 @@
+package filter
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRuleStore(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "rules.db")
+	db, err := sql.Open("sqlite", dbFile)
+	require.Nil(t, err)
+	defer db.Close()
+	exec := func(query string, args ...any) {
+		_, err := db.Exec(query, args...)
+		require.Nil(t, err)
+	}
+	exec(RULE_STORE_SCHEMA)
+	exec("INSERT INTO rules (name) VALUES ('tenant'), ('local')")
+	exec("INSERT INTO rules (name, enabled) VALUES ('disabled', 0)")
+	exec("INSERT INTO rule_headers (rule, name, value) VALUES ('local', 'X-Local', 'yes'), ('disabled', 'X-Disabled', 'yes')")
+	exec("INSERT INTO rule_recipients (rule, pattern) VALUES ('local', '@localdomain\\.ext$')")
+	exec("INSERT INTO mapped_headers (rule, name, key, mode, default_value, mapping) VALUES ('tenant', 'X-Tenant', 'recipient-domain', 'join', 'none', 'tenants')")
+	exec("INSERT INTO mappings (mapping, key, value) VALUES ('tenants', 'localdomain.ext', 'local'), ('tenants', 'elsewhere.ext', 'remote')")
+
+	configFile := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`smtpd_filter_addheader:
+  rules_db: %s
+  rules_db_refresh: 0
+  rules:
+    - name: config
+      header:
+        - X-Config=yes
+`, dbFile)
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+
+	f := NewFilter(nil, nil)
+	message := []string{"Subject: stored", "", "body"}
+	simulate := func(recipients ...string) []string {
+		env := Envelope{From: "fromuser@example.org", To: recipients, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+		result, err := Simulate(f, &env, message)
+		require.Nil(t, err)
+		header, _ := splitMessage(result.Lines)
+		return header
+	}
+	require.Equal(t, []string{"Subject: stored", "X-Config: yes", "X-Local: yes", "X-Tenant: local, remote"}, simulate("touser@localdomain.ext", "other@elsewhere.ext"))
+	require.Equal(t, []string{"config", "local", "tenant"}, ruleNames(f.Rules()))
+
+	exec("UPDATE mappings SET value = 'changed' WHERE key = 'elsewhere.ext'")
+	exec("UPDATE rules SET enabled = 0 WHERE name = 'local'")
+	f.refreshStore()
+	require.Equal(t, []string{"config", "tenant"}, ruleNames(f.Rules()))
+	require.Equal(t, []string{"Subject: stored", "X-Config: yes", "X-Tenant: changed"}, simulate("other@elsewhere.ext"))
+
+	// an invalid rule keeps the current rules and the cached rows
+	exec("INSERT INTO rules (name) VALUES ('empty')")
+	f.refreshStore()
+	require.Equal(t, []string{"config", "tenant"}, ruleNames(f.Rules()))
+	require.Len(t, f.store.Rules(), 1)
+	require.Empty(t, f.CheckRules())
+	require.Len(t, NewFilter(nil, nil).CheckRules(), 1)
+
+	// rejected rows are skipped until the database or the config changes
+	rows, err := f.store.Read()
+	require.Nil(t, err)
+	require.False(t, f.store.Changed(rows))
+	require.Nil(t, f.Reload())
+	require.True(t, f.store.Changed(rows))
+	f.refreshStore()
+	require.False(t, f.store.Changed(rows))
+
+	// a rule name in both the config and the database is a duplicate
+	exec("DELETE FROM rules WHERE name = 'empty'")
+	exec("INSERT INTO rules (name) VALUES ('config')")
+	exec("INSERT INTO rule_headers (rule, name, value) VALUES ('config', 'X-Stored', 'yes')")
+	f.refreshStore()
+	require.Equal(t, []string{"config", "tenant"}, ruleNames(f.Rules()))
+	require.Len(t, NewFilter(nil, nil).CheckRules(), 1)
+
+	// the rules load once the database is fixed
+	exec("DELETE FROM rule_headers WHERE rule = 'config'")
+	exec("DELETE FROM rules WHERE name = 'config'")
+	exec("UPDATE rules SET enabled = 1 WHERE name = 'local'")
+	f.refreshStore()
+	require.Equal(t, []string{"config", "local", "tenant"}, ruleNames(f.Rules()))
+
+	// a rejected config reload is not loaded by the next refresh
+	rejected := fmt.Sprintf("smtpd_filter_addheader:\n  rules_db: %s\n  recipient:\n    - '(unclosed'\n  rules:\n    - name: config\n      header:\n        - X-Config=rejected\n", dbFile)
+	require.Nil(t, os.WriteFile(configFile, []byte(rejected), 0600))
+	require.NotNil(t, f.Reload())
+	exec("UPDATE mappings SET value = 'refreshed' WHERE key = 'elsewhere.ext'")
+	f.refreshStore()
+	require.Equal(t, []string{"Subject: stored", "X-Config: yes", "X-Tenant: refreshed"}, simulate("other@elsewhere.ext"))
+
+	// the refresh follows rules-db-refresh on reload
+	require.Nil(t, os.WriteFile(configFile, []byte(strings.Replace(config, "rules_db_refresh: 0", "rules_db_refresh: 60", 1)), 0600))
+	require.Nil(t, f.Reload())
+	require.Equal(t, 60, f.storeRefresh)
+	require.NotNil(t, f.storeStop)
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	require.Nil(t, f.Reload())
+	require.Equal(t, 0, f.storeRefresh)
+	require.Nil(t, f.storeStop)
+
+	require.Nil(t, os.WriteFile(configFile, []byte("smtpd_filter_addheader:\n  rules_db: "+filepath.Join(dir, "missing.db")+"\n"), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	require.Len(t, NewFilter(nil, nil).CheckRules(), 1)
+}
+
+func ruleNames(rules *RuleSet) []string {
+	names := []string{}
+	for _, rule := range rules.NamedRules {
+		names = append(names, rule.Name)
+	}
+	return names
+}
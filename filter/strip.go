@@ -0,0 +1,110 @@
+package filter
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// buildStrip reads the inbound header stripping options
+func (r *RuleSet) buildStrip() []error {
+	r.StripInbound = ViperGetBool("strip-inbound")
+	r.StripAction = ViperGetString("strip-action")
+	switch r.StripAction {
+	case "":
+		r.StripAction = "remove"
+	case "remove", "rename":
+	default:
+		return []error{&ConfigError{"strip-action", r.StripAction, fmt.Errorf("expected remove or rename")}}
+	}
+	return []error{}
+}
+
+// OwnHeaders returns the names of every header the rules may add
+func (r *RuleSet) OwnHeaders() []string {
+	names := []string{}
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if name != "" && !seen[strings.ToLower(name)] {
+			seen[strings.ToLower(name)] = true
+			names = append(names, name)
+		}
+	}
+	for _, rule := range r.HeaderRules() {
+		for _, key := range rule.HeaderKeys() {
+			add(key)
+		}
+	}
+	add(r.TraceHeader)
+	if r.SignKey != nil {
+		add(r.SignatureHeader)
+	}
+	return names
+}
+
+// stripInbound removes or renames copies of our own headers in messages from external sessions
+func (f *Filter) stripInbound(log *slog.Logger, session *Session, message *Message, header []string, record *AuditRecord) []string {
+	rules := message.Rules
+	if !rules.IsExternal(session) {
+		return header
+	}
+	names := rules.OwnHeaders()
+	return f.stripFields(log, message, header, record, "strip", func(field []string) bool {
+		name := fieldName(field)
+		for _, ownName := range names {
+			if strings.EqualFold(name, ownName) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// stripFields removes or renames the header fields selected by match
+// according to the strip-action, recording the changes under rule
+func (f *Filter) stripFields(log *slog.Logger, message *Message, header []string, record *AuditRecord, rule string, match func([]string) bool) []string {
+	rules := message.Rules
+	dryRun := rules.IsDryRun(rule)
+	output := []string{}
+	modified := false
+	for _, field := range headerFields(header) {
+		if !match(field) {
+			output = append(output, field...)
+			continue
+		}
+		name := fieldName(field)
+		original := name + ": " + fieldValue(field)
+		if rules.StripAction == "rename" {
+			renamed := append([]string{"X-Original-" + field[0]}, field[1:]...)
+			detail := original + " -> X-Original-" + original
+			if dryRun {
+				log.Info("dry-run: header not renamed", "rule", rule, "action", "rename-header", "header", original, "dry_run", true)
+				message.Actions = append(message.Actions, Action{rule, "dry-run rename-header", detail})
+				f.Metrics.dryRun(rule, "rename-header")
+				output = append(output, field...)
+				continue
+			}
+			log.Info("header renamed", "rule", rule, "action", "rename-header", "header", original)
+			message.Actions = append(message.Actions, Action{rule, "rename-header", detail})
+			record.Changed = append(record.Changed, detail)
+			output = append(output, renamed...)
+			modified = true
+			continue
+		}
+		if dryRun {
+			log.Info("dry-run: header not removed", "rule", rule, "action", "remove-header", "header", original, "dry_run", true)
+			message.Actions = append(message.Actions, Action{rule, "dry-run remove-header", original})
+			f.Metrics.dryRun(rule, "remove-header")
+			output = append(output, field...)
+			continue
+		}
+		log.Info("header removed", "rule", rule, "action", "remove-header", "header", original)
+		message.Actions = append(message.Actions, Action{rule, "remove-header", original})
+		record.Removed = append(record.Removed, original)
+		modified = true
+	}
+	if modified {
+		record.Rules = append(record.Rules, rule)
+	}
+	return output
+}
@@ -0,0 +1,66 @@
+package filter
+
+import (
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStripInbound(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+	ViperSet("strip-inbound", true)
+	defer func() {
+		ViperSet("strip-inbound", false)
+		ViperSet("strip-action", "remove")
+	}()
+
+	message, err := ReadMessage(strings.NewReader("Subject: spoof\nx-internal-origin: forged\n  folded\nX-Other: kept\n\nbody\n"))
+	require.Nil(t, err)
+	env := Envelope{From: "fromuser@example.org", To: []string{"touser@localdomain.ext"}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+	simulate := func() *SimulateResult {
+		f := NewFilter(nil, nil)
+		f.AddHeader("X-Internal-Origin", "yes")
+		result, err := Simulate(f, &env, message)
+		require.Nil(t, err)
+		return result
+	}
+
+	result := simulate()
+	require.Equal(t, []string{"Subject: spoof", "X-Other: kept", "X-Internal-Origin: yes", "", "body"}, result.Lines)
+	require.Equal(t, Action{"strip", "remove-header", "x-internal-origin: forged folded"}, result.Actions[0])
+
+	ViperSet("strip-action", "rename")
+	result = simulate()
+	require.Equal(t, []string{"Subject: spoof", "X-Original-x-internal-origin: forged", "  folded", "X-Other: kept", "X-Internal-Origin: yes", "", "body"}, result.Lines)
+
+	// a message without a body is stripped too
+	headerOnly := message[:3]
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Internal-Origin", "yes")
+	result, err = Simulate(f, &env, headerOnly)
+	require.Nil(t, err)
+	require.Equal(t, []string{"Subject: spoof", "X-Original-x-internal-origin: forged", "  folded", "X-Internal-Origin: yes"}, result.Lines)
+
+	// with DMARC the header of a message without a body is processed at its end
+	ViperSet("dmarc", true)
+	ViperSet("authserv-id", "mx.localdomain.ext")
+	defer func() {
+		ViperSet("dmarc", false)
+		ViperSet("authserv-id", "")
+	}()
+	f = NewFilter(nil, nil)
+	f.AddHeader("X-Internal-Origin", "yes")
+	f.Resolver = NewMemoryResolver()
+	forged := append([]string{"Authentication-Results: mx.localdomain.ext; dmarc=pass header.from=example.org"}, headerOnly...)
+	result, err = Simulate(f, &env, forged)
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(result.Lines[0], "Authentication-Results: mx.localdomain.ext; dkim=none"), result.Lines[0])
+	require.Contains(t, result.Lines, "X-Original-Authentication-Results: mx.localdomain.ext; dmarc=pass header.from=example.org")
+	require.Equal(t, []string{"Subject: spoof", "X-Original-x-internal-origin: forged", "  folded", "X-Internal-Origin: yes"}, result.Lines[len(result.Lines)-4:])
+	ViperSet("dmarc", false)
+
+	env.AuthUser = "authuser"
+	result = simulate()
+	require.Equal(t, []string{"Subject: spoof", "x-internal-origin: forged", "  folded", "X-Other: kept", "X-Internal-Origin: yes", "", "body"}, result.Lines)
+}
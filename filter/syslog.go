@@ -0,0 +1,120 @@
+package filter
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const SYSLOG_SOCKET = "/dev/log"
+
+// messages are dropped rather than stall the filter when syslogd is not reading
+const SYSLOG_WRITE_TIMEOUT = time.Second
+
+// syslog severities
+const (
+	LOG_ERR     = 3
+	LOG_WARNING = 4
+	LOG_INFO    = 6
+	LOG_DEBUG   = 7
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// Syslog sends messages to the local syslog daemon over a unix datagram socket
+type Syslog struct {
+	Path     string
+	Facility int
+	Tag      string
+	conn     net.Conn
+	mutex    sync.Mutex
+}
+
+func NewSyslog(path, facility, tag string) (*Syslog, error) {
+	code, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("invalid syslog facility '%s'", facility)
+	}
+	if path == "" {
+		path = SYSLOG_SOCKET
+	}
+	s := Syslog{Path: path, Facility: code, Tag: tag}
+	err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Syslog) connect() error {
+	conn, err := net.Dial("unixgram", s.Path)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// Send writes message with severity, reconnecting once if the socket has gone away
+func (s *Syslog) Send(severity int, message string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	line := fmt.Sprintf("<%d>%s %s[%d]: %s", s.Facility<<3|severity, time.Now().Format(time.Stamp), s.Tag, os.Getpid(), strings.TrimRight(message, "\n"))
+	if s.conn != nil {
+		err := s.write(line)
+		if err == nil || os.IsTimeout(err) {
+			return err
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	err := s.connect()
+	if err != nil {
+		return err
+	}
+	return s.write(line)
+}
+
+func (s *Syslog) write(line string) error {
+	err := s.conn.SetWriteDeadline(time.Now().Add(SYSLOG_WRITE_TIMEOUT))
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.Write([]byte(line))
+	return err
+}
+
+func (s *Syslog) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
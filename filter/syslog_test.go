@@ -0,0 +1,81 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslog(t *testing.T) {
+	Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+
+	socket := filepath.Join(t.TempDir(), "log")
+	listener, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.Nil(t, err)
+	defer listener.Close()
+
+	received := make(chan string, 1024)
+	go func() {
+		buf := make([]byte, 8192)
+		for {
+			n, err := listener.Read(buf)
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- string(buf[:n])
+		}
+	}()
+	next := func() (string, bool) {
+		select {
+		case message, ok := <-received:
+			return message, ok
+		case <-time.After(100 * time.Millisecond):
+			return "", false
+		}
+	}
+
+	ViperSet("log-output", "syslog")
+	ViperSet("syslog-socket", socket)
+	ViperSet("syslog-facility", "local3")
+	defer func() {
+		ViperSet("log-output", "stderr")
+		NewFilter(nil, nil)
+	}()
+	f := NewFilter(nil, nil)
+	f.AddHeader("X-Syslog", "logged")
+	replayTranscript(t, f)
+
+	messages := []string{}
+	for message, ok := next(); ok; message, ok = next() {
+		messages = append(messages, message)
+	}
+	tag := fmt.Sprintf(" %s[%d]: ", f.Name, os.Getpid())
+	info := fmt.Sprintf("<%d>", 19<<3|LOG_INFO)
+	warning := fmt.Sprintf("<%d>", 19<<3|LOG_WARNING)
+	added := false
+	for _, message := range messages {
+		require.Contains(t, message, tag)
+		if strings.Contains(message, "header added") {
+			require.True(t, strings.HasPrefix(message, info), message)
+			require.Contains(t, message, "session=deadbeef")
+			added = true
+		}
+	}
+	require.True(t, added)
+
+	f.log.Warn("protocol error: unparsable line", "line", "x")
+	message, ok := next()
+	require.True(t, ok)
+	require.True(t, strings.HasPrefix(message, warning), message)
+}
+
+func TestSyslogFacility(t *testing.T) {
+	_, err := NewSyslog(filepath.Join(t.TempDir(), "log"), "bogus", "test")
+	require.NotNil(t, err)
+}
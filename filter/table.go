@@ -0,0 +1,258 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// command used to read db: tables
+var MakemapCommand = "makemap"
+
+// makemap is stopped if it runs longer than this, since tables are read
+// while filtering
+var MakemapTimeout = 10 * time.Second
+
+// table files are checked for changes at most this often
+const TABLE_CHECK_INTERVAL = time.Second
+
+// Table is a smtpd table(5) of keys with optional values; file: tables are
+// read directly, db: tables are read with makemap -U.  Values are kept as
+// written; list tables split them on commas.  Tables reload when the file
+// changes.
+type Table struct {
+	Spec    string
+	Type    string
+	Path    string
+	keys    []string
+	values  map[string]string
+	modTime time.Time
+	size    int64
+	checked time.Time
+	mutex   sync.Mutex
+}
+
+// NewTable opens a table given as file:PATH, db:PATH or PATH; paths ending
+// in .db are db tables
+func NewTable(spec string) (*Table, error) {
+	t := Table{Spec: spec, Type: "file", Path: spec}
+	if kind, path, ok := strings.Cut(spec, ":"); ok && (kind == "file" || kind == "db") {
+		t.Type = kind
+		t.Path = path
+	} else if strings.HasSuffix(spec, ".db") {
+		t.Type = "db"
+	}
+	if t.Path == "" {
+		return nil, fmt.Errorf("missing table path")
+	}
+	err := t.load()
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// parseTable reads table(5) lines: a key, optionally followed by whitespace
+// and a value; lines starting with # are comments
+func parseTable(r io.Reader) ([]string, map[string]string, error) {
+	keys := []string{}
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key := strings.Fields(text)[0]
+		value := strings.TrimSpace(text[len(key):])
+		key = strings.ToLower(key)
+		if _, ok := values[key]; ok {
+			return nil, nil, fmt.Errorf("line %d: duplicate key '%s'", line, key)
+		}
+		keys = append(keys, key)
+		values[key] = value
+	}
+	return keys, values, scanner.Err()
+}
+
+// listValues returns the items of a comma separated table(5) list value
+func listValues(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// read returns the table contents as table(5) text
+func (t *Table) read() ([]byte, error) {
+	if t.Type == "db" {
+		ctx, cancel := context.WithTimeout(context.Background(), MakemapTimeout)
+		defer cancel()
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, MakemapCommand, "-U", t.Path)
+		cmd.Stderr = &stderr
+		cmd.WaitDelay = time.Second
+		data, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s -U %s failed: %v %s", MakemapCommand, t.Path, err, strings.TrimSpace(stderr.String()))
+		}
+		return data, nil
+	}
+	return os.ReadFile(t.Path)
+}
+
+func (t *Table) load() error {
+	info, err := os.Stat(t.Path)
+	if err != nil {
+		return err
+	}
+	data, err := t.read()
+	if err != nil {
+		return err
+	}
+	keys, values, err := parseTable(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%s: %v", t.Path, err)
+	}
+	t.keys = keys
+	t.values = values
+	t.modTime = info.ModTime()
+	t.size = info.Size()
+	t.checked = time.Now()
+	return nil
+}
+
+// refresh reloads the table if the file changed; a table that fails to
+// load keeps its previous contents
+func (t *Table) refresh() {
+	if time.Since(t.checked) < TABLE_CHECK_INTERVAL {
+		return
+	}
+	t.checked = time.Now()
+	info, err := os.Stat(t.Path)
+	if err != nil {
+		slog.Warn("table stat failed", "table", t.Spec, "error", err)
+		return
+	}
+	if info.ModTime().Equal(t.modTime) && info.Size() == t.size {
+		return
+	}
+	err = t.load()
+	if err != nil {
+		slog.Warn("table reload failed; keeping current contents", "table", t.Spec, "error", err)
+		return
+	}
+	slog.Info("table reloaded", "table", t.Spec, "keys", len(t.keys))
+}
+
+// Lookup returns the value of a key as written in the table
+func (t *Table) Lookup(key string) (string, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.refresh()
+	value, ok := t.values[strings.ToLower(key)]
+	return value, ok
+}
+
+// Keys returns the table keys in sorted order
+func (t *Table) Keys() []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.refresh()
+	keys := append([]string{}, t.keys...)
+	sort.Strings(keys)
+	return keys
+}
+
+// addressKeys returns the keys matching an address in smtpd lookup order:
+// the address, @domain, the domain and the local part
+func addressKeys(address string) []string {
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return []string{address}
+	}
+	return []string{address, "@" + domain, domain, local}
+}
+
+// LookupAddress returns the key and list values of the first table entry
+// matching the address
+func (t *Table) LookupAddress(address string) (string, []string, bool) {
+	for _, key := range addressKeys(address) {
+		value, ok := t.Lookup(key)
+		if ok {
+			return key, listValues(value), true
+		}
+	}
+	return "", nil, false
+}
+
+func (t *Table) String() string {
+	return t.Type + ":" + t.Path
+}
+
+// buildTables opens the tables of a config list
+func buildTables(key string, specs []string) ([]*Table, []error) {
+	tables := []*Table{}
+	errs := []error{}
+	for _, spec := range specs {
+		table, err := NewTable(spec)
+		if err != nil {
+			errs = append(errs, &ConfigError{key, spec, err})
+			continue
+		}
+		tables = append(tables, table)
+	}
+	return tables, errs
+}
+
+// buildHeaderTables opens the tables of a list of NAME=TABLE header
+// entries, each a mapped header keyed by recipient with the first match
+func buildHeaderTables(key string, entries []string, headers map[string]string, mapped map[string]*MappedHeader) []error {
+	errs := []error{}
+	for _, entry := range entries {
+		name, spec, err := ParseHeader(entry)
+		if err == nil {
+			err = ValidateHeaderName(name)
+		}
+		if err == nil {
+			err = checkMappedName(name, headers, mapped)
+		}
+		if err != nil {
+			errs = append(errs, &ConfigError{key, entry, err})
+			continue
+		}
+		table, err := NewTable(spec)
+		if err != nil {
+			errs = append(errs, &ConfigError{key, entry, err})
+			continue
+		}
+		header := NewMappedHeader(name)
+		header.Table = table
+		mapped[name] = header
+	}
+	return errs
+}
+
+// tableList returns the specs of a list of tables
+func tableList(tables []*Table) []string {
+	specs := []string{}
+	for _, table := range tables {
+		specs = append(specs, table.Spec)
+	}
+	return specs
+}
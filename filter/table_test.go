@@ -0,0 +1,147 @@
+package filter
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTable(t *testing.T) {
+	keys, values, err := parseTable(strings.NewReader(`# recipients
+touser@localdomain.ext
+@example.org   tenant-a
+  # indented comment
+Example.NET	tenant-b, tenant-c
+acme.example   Acme, Inc.
+support        #ticket
+
+postmaster
+`))
+	require.Nil(t, err)
+	require.Equal(t, []string{"touser@localdomain.ext", "@example.org", "example.net", "acme.example", "support", "postmaster"}, keys)
+	require.Equal(t, "", values["touser@localdomain.ext"])
+	require.Equal(t, "tenant-a", values["@example.org"])
+	require.Equal(t, "tenant-b, tenant-c", values["example.net"])
+	require.Equal(t, "Acme, Inc.", values["acme.example"])
+	require.Equal(t, "#ticket", values["support"])
+	require.Equal(t, []string{"tenant-b", "tenant-c"}, listValues(values["example.net"]))
+	require.Equal(t, []string{}, listValues(values["postmaster"]))
+
+	_, _, err = parseTable(strings.NewReader("key one\nKEY two\n"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "line 2: duplicate key 'key'")
+}
+
+func TestTableLookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tenants")
+	require.Nil(t, os.WriteFile(path, []byte("touser@localdomain.ext alpha\n@elsewhere.ext beta\nlocaldomain.ext gamma\nadmin delta\n"), 0600))
+	table, err := NewTable("file:" + path)
+	require.Nil(t, err)
+	require.Equal(t, "file", table.Type)
+
+	lookup := func(address string) string {
+		_, values, ok := table.LookupAddress(address)
+		if !ok {
+			return "-"
+		}
+		return strings.Join(values, ",")
+	}
+	require.Equal(t, "alpha", lookup("touser@localdomain.ext"))
+	require.Equal(t, "alpha", lookup("ToUser@LocalDomain.ext"))
+	require.Equal(t, "beta", lookup("anyone@elsewhere.ext"))
+	require.Equal(t, "gamma", lookup("other@localdomain.ext"))
+	require.Equal(t, "delta", lookup("admin@example.org"))
+	require.Equal(t, "-", lookup("nobody@example.org"))
+
+	// the table reloads when the file changes
+	require.Nil(t, os.WriteFile(path, []byte("touser@localdomain.ext changed\n"), 0600))
+	table.checked = time.Time{}
+	require.Equal(t, "changed", lookup("touser@localdomain.ext"))
+	require.Equal(t, "-", lookup("anyone@elsewhere.ext"))
+
+	// a bad table keeps the current contents
+	require.Nil(t, os.WriteFile(path, []byte("dup one\ndup two\n"), 0600))
+	table.checked = time.Time{}
+	require.Equal(t, "changed", lookup("touser@localdomain.ext"))
+
+	_, err = NewTable("file:" + filepath.Join(t.TempDir(), "missing"))
+	require.NotNil(t, err)
+}
+
+func TestDBTable(t *testing.T) {
+	dir := t.TempDir()
+	// makemap -U dumps a db table as text
+	makemap := filepath.Join(dir, "makemap")
+	script := "#!/bin/sh\n[ \"$1\" = -U ] || exit 1\nprintf 'touser@localdomain.ext\\tfrom-db\\n'\n"
+	require.Nil(t, os.WriteFile(makemap, []byte(script), 0700))
+	defer func(command string) { MakemapCommand = command }(MakemapCommand)
+	MakemapCommand = makemap
+
+	path := filepath.Join(dir, "tenants.db")
+	require.Nil(t, os.WriteFile(path, []byte("binary"), 0600))
+	for _, spec := range []string{"db:" + path, path} {
+		table, err := NewTable(spec)
+		require.Nil(t, err)
+		require.Equal(t, "db", table.Type)
+		value, ok := table.Lookup("touser@localdomain.ext")
+		require.True(t, ok)
+		require.Equal(t, "from-db", value)
+	}
+
+	MakemapCommand = filepath.Join(dir, "missing")
+	_, err := NewTable("db:" + path)
+	require.NotNil(t, err)
+
+	// a hung makemap is stopped
+	require.Nil(t, os.WriteFile(makemap, []byte("#!/bin/sh\nexec sleep 10\n"), 0700))
+	MakemapCommand = makemap
+	defer func(timeout time.Duration) { MakemapTimeout = timeout }(MakemapTimeout)
+	MakemapTimeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err = NewTable("db:" + path)
+	require.NotNil(t, err)
+	require.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestTableRules(t *testing.T) {
+	dir := t.TempDir()
+	recipients := filepath.Join(dir, "recipients")
+	require.Nil(t, os.WriteFile(recipients, []byte("localdomain.ext\n"), 0600))
+	tenants := filepath.Join(dir, "tenants")
+	require.Nil(t, os.WriteFile(tenants, []byte("touser@localdomain.ext alpha\n@elsewhere.ext beta\n@acme.example Acme, Inc.\n"), 0600))
+	configFile := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`smtpd_filter_addheader:
+  rules:
+    - name: local
+      header:
+        - X-Local=yes
+      recipient_table: file:%s
+    - name: tenant
+      header_table:
+        - X-Tenant=file:%s
+`, recipients, tenants)
+	require.Nil(t, os.WriteFile(configFile, []byte(config), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	defer Init("smtpd-filter-addheader", Version, filepath.Join("testdata", "config.yaml"))
+
+	message := []string{"Subject: tables", "", "body"}
+	simulate := func(recipient string) []string {
+		env := Envelope{From: "fromuser@example.org", To: []string{recipient}, Remote: "1.2.3.4:11223", Local: "5.6.7.8:25"}
+		result, err := Simulate(NewFilter(nil, nil), &env, message)
+		require.Nil(t, err)
+		header, _ := splitMessage(result.Lines)
+		return header
+	}
+	require.Equal(t, []string{"Subject: tables", "X-Local: yes", "X-Tenant: alpha"}, simulate("touser@localdomain.ext"))
+	require.Equal(t, []string{"Subject: tables", "X-Tenant: beta"}, simulate("other@elsewhere.ext"))
+	require.Equal(t, []string{"Subject: tables", "X-Tenant: Acme, Inc."}, simulate("other@acme.example"))
+	require.Equal(t, []string{"Subject: tables"}, simulate("other@example.org"))
+
+	require.Nil(t, os.WriteFile(configFile, []byte("smtpd_filter_addheader:\n  header_table:\n    - X-Tenant=file:"+filepath.Join(dir, "missing")+"\n"), 0600))
+	Init("smtpd-filter-addheader", Version, configFile)
+	require.Len(t, NewFilter(nil, nil).CheckRules(), 1)
+}